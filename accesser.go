@@ -0,0 +1,404 @@
+// * 訪問控制
+// * 靜態允許和拒絕名單，支持CIDR及外部名單文件(每行一個CIDR，#為注釋)，文件變更後自動重新加載
+// * 名單構建為前綴樹，查詢時間只與地址長度有關，與名單大小無關
+// * 同時匹配時前綴更長的規則優先，前綴相同時拒絕優先
+// * 另可手動封禁IP或CIDR(見adminer.go)，到期後自動失效
+// * 設置Store後手動封禁同時寫入Store，由快照保存，重啓後恢復；多實例共用Redis時每隔Reload秒從Store同步其他實例的封禁
+// * 未設置Store時手動封禁只在本進程内存中，重啓後丟失
+package goweber
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 訪問控制結果
+const (
+	AccessNone  = iota // 不在名單中
+	AccessAllow        // 允許名單，不受限流和暴力破解封禁
+	AccessDeny         // 拒絕名單，直接返回403
+)
+
+// AccessBan 手動封禁
+// AccessBan is a manual ban of an address or prefix
+type AccessBan struct {
+	Prefix  string    `json:"prefix"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"` // 零值為永久
+}
+
+// 靜態名單規則
+type accessRule struct {
+	prefix netip.Prefix
+	action int8
+}
+
+// Accesser 訪問控制，參數修改後需調用Load
+// Accesser holds static allow and deny lists and manual bans
+type Accesser struct {
+	sync.RWMutex
+	Allow      []string // 允許的CIDR
+	Deny       []string // 拒絕的CIDR
+	AllowFiles []string // 允許名單文件
+	DenyFiles  []string // 拒絕名單文件
+	Reload     int      // 檢查名單文件變更及從Store同步手動封禁的間隔秒，0為不檢查
+	Store      Store    // 手動封禁的存儲，nil為只保存在本進程
+	// 名單文件重新加載後調用，err不為nil時保留舊名單
+	OnReload  func(file string, err error)
+	trie      *ipTrie
+	rules     []accessRule
+	bans      map[netip.Prefix]AccessBan
+	modTimes  map[string]time.Time
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewAccesser() *Accesser {
+	return &Accesser{
+		bans: make(map[netip.Prefix]AccessBan),
+		stop: make(chan struct{}),
+	}
+}
+
+// Load 構建名單，出錯時保留舊名單
+// Load builds the lists, the old lists are kept on error
+func (this *Accesser) Load() error {
+	this.RLock()
+	allow, deny := this.Allow, this.Deny
+	allowFiles, denyFiles := this.AllowFiles, this.DenyFiles
+	this.RUnlock()
+
+	var rules []accessRule
+	modTimes := make(map[string]time.Time)
+	add := func(cidrs []string, action int8, source string) error {
+		for _, cidr := range cidrs {
+			p, err := parsePrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("%s: %w", source, err)
+			}
+			rules = append(rules, accessRule{p, action})
+		}
+		return nil
+	}
+	if err := add(allow, AccessAllow, "allow"); err != nil {
+		return err
+	}
+	if err := add(deny, AccessDeny, "deny"); err != nil {
+		return err
+	}
+	for _, list := range []struct {
+		files  []string
+		action int8
+	}{{allowFiles, AccessAllow}, {denyFiles, AccessDeny}} {
+		for _, file := range list.files {
+			cidrs, modTime, err := readCIDRFile(file)
+			if err != nil {
+				return err
+			}
+			if err := add(cidrs, list.action, file); err != nil {
+				return err
+			}
+			modTimes[file] = modTime
+		}
+	}
+	this.Lock()
+	this.rules = rules
+	this.modTimes = modTimes
+	this.build()
+	this.Unlock()
+	return nil
+}
+
+// 由靜態名單和未過期的手動封禁重新構建前綴樹，需持有寫鎖
+func (this *Accesser) build() {
+	trie := &ipTrie{}
+	for _, rule := range this.rules {
+		trie.insert(rule.prefix, rule.action, time.Time{})
+	}
+	now := time.Now()
+	for p, ban := range this.bans {
+		if !ban.Until.IsZero() && !now.Before(ban.Until) {
+			delete(this.bans, p)
+			continue
+		}
+		trie.insert(p, AccessDeny, ban.Until)
+	}
+	if trie.v4 == nil && trie.v6 == nil {
+		trie = nil
+	}
+	this.trie = trie
+}
+
+// Ban 手動封禁IP或CIDR，ttl為0時永久封禁，同一前綴重復封禁時覆蓋，設置Store時先寫入Store
+// Ban manually denies an address or CIDR, forever when ttl is 0, replacing an existing ban of the same prefix, written to Store first when set
+func (this *Accesser) Ban(cidr, reason string, ttl time.Duration) (AccessBan, error) {
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return AccessBan{}, err
+	}
+	ban := AccessBan{Prefix: p.String(), Reason: reason, Created: time.Now()}
+	if ttl > 0 {
+		ban.Until = ban.Created.Add(ttl)
+	}
+	if this.Store != nil {
+		if err := this.Store.SetBlock(storeAccessBan+ban.Prefix, ban.Until); err != nil {
+			return AccessBan{}, err
+		}
+	}
+	this.Lock()
+	this.bans[p] = ban
+	this.build()
+	this.Unlock()
+	return ban, nil
+}
+
+// Unban 解除與cidr重叠的手動封禁，返回解除的封禁，設置Store時包括其他實例的封禁
+// Unban removes the manual bans overlapping cidr and returns them, including other instances' bans when Store is set
+func (this *Accesser) Unban(cidr string) ([]AccessBan, error) {
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.SyncBans(); err != nil {
+		return nil, err
+	}
+	this.Lock()
+	defer this.Unlock()
+	var removed []AccessBan
+	for bp, ban := range this.bans {
+		if !p.Overlaps(bp) {
+			continue
+		}
+		if this.Store != nil {
+			if err := this.Store.Delete(storeAccessBan + ban.Prefix); err != nil {
+				this.build()
+				return removed, err
+			}
+		}
+		delete(this.bans, bp)
+		removed = append(removed, ban)
+	}
+	if len(removed) > 0 {
+		this.build()
+	}
+	return removed, nil
+}
+
+// SyncBans 從Store讀取手動封禁替換本進程的列表，保留本進程記錄的原因，未設置Store時不處理
+// SyncBans replaces the manual bans with those in Store, keeping locally known reasons, a no-op without Store
+func (this *Accesser) SyncBans() error {
+	if this.Store == nil {
+		return nil
+	}
+	entries, err := this.Store.List(storeAccessBan)
+	if err != nil {
+		return err
+	}
+	this.Lock()
+	defer this.Unlock()
+	bans := make(map[netip.Prefix]AccessBan, len(entries))
+	for _, e := range entries {
+		p, err := netip.ParsePrefix(strings.TrimPrefix(e.Key, storeAccessBan))
+		if err != nil {
+			continue
+		}
+		ban, ok := this.bans[p]
+		if !ok {
+			// 其他實例或快照中的封禁，原因未保存在Store中
+			ban = AccessBan{Prefix: p.String(), Reason: "store"}
+		}
+		ban.Until = e.Expire
+		bans[p] = ban
+	}
+	this.bans = bans
+	this.build()
+	return nil
+}
+
+// Bans 未過期的手動封禁，按前綴排序
+// Bans lists the manual bans that have not expired, sorted by prefix
+func (this *Accesser) Bans() []AccessBan {
+	this.RLock()
+	defer this.RUnlock()
+	now := time.Now()
+	res := []AccessBan{}
+	for _, ban := range this.bans {
+		if ban.Until.IsZero() || now.Before(ban.Until) {
+			res = append(res, ban)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Prefix < res[j].Prefix })
+	return res
+}
+
+// Check 查詢IP的訪問控制結果
+// Check returns AccessNone, AccessAllow or AccessDeny for ip
+func (this *Accesser) Check(ip string) int {
+	if this == nil {
+		return AccessNone
+	}
+	this.RLock()
+	trie := this.trie
+	this.RUnlock()
+	if trie == nil {
+		return AccessNone
+	}
+	addr, ok := NormalizeIP(ip)
+	if !ok {
+		return AccessNone
+	}
+	return int(trie.lookup(addr, time.Now()))
+}
+
+// Watch 定時檢查名單文件變更并從Store同步手動封禁，Close後停止
+// Watch polls the list files for changes and syncs manual bans from Store until Close
+func (this *Accesser) Watch() {
+	if this.Reload <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(this.Reload) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			this.reload()
+		}
+	}
+}
+
+// 任一名單文件變更時重新構建，同步Store中的手動封禁
+func (this *Accesser) reload() {
+	if err := this.SyncBans(); err != nil && this.OnReload != nil {
+		this.OnReload("store", err)
+	}
+	this.RLock()
+	modTimes := this.modTimes
+	this.RUnlock()
+	for file, old := range modTimes {
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().Equal(old) {
+			continue
+		}
+		err = this.Load()
+		if this.OnReload != nil {
+			this.OnReload(file, err)
+		}
+		return
+	}
+}
+
+// Close 停止檢查名單文件
+func (this *Accesser) Close() {
+	this.closeOnce.Do(func() { close(this.stop) })
+}
+
+func (this *Accesser) String() string {
+	return fmt.Sprintf("&{Allow:%v Deny:%v AllowFiles:%v DenyFiles:%v Reload:%d}",
+		this.Allow, this.Deny, this.AllowFiles, this.DenyFiles, this.Reload)
+}
+
+// 讀取名單文件，每行一個CIDR或IP，忽略空行和#注釋
+func readCIDRFile(file string) ([]string, time.Time, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var cidrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	return cidrs, info.ModTime(), scanner.Err()
+}
+
+// 解析CIDR或單個IP為前綴
+func parsePrefix(s string) (netip.Prefix, error) {
+	n, err := ParseCIDR(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr, _ := netip.AddrFromSlice(n.IP)
+	ones, _ := n.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), ones).Masked(), nil
+}
+
+// IP前綴樹，IPv4和IPv6分開，每層按一個bit分支
+type ipTrie struct {
+	v4, v6 *trieNode
+}
+
+type trieNode struct {
+	child  [2]*trieNode
+	action int8      // 靜態名單結果
+	ban    time.Time // 手動封禁到期時間，零值為沒有封禁
+}
+
+// until為零值時是靜態規則，否則為到期的手動封禁
+func (this *ipTrie) insert(p netip.Prefix, action int8, until time.Time) {
+	root := &this.v6
+	if p.Addr().Is4() {
+		root = &this.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+	node := *root
+	b := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		bit := b[i/8] >> (7 - i%8) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &trieNode{}
+		}
+		node = node.child[bit]
+	}
+	switch {
+	case !until.IsZero():
+		if until.After(node.ban) {
+			node.ban = until
+		}
+	case node.action != AccessDeny:
+		node.action = action
+	}
+}
+
+// 返回匹配的最長前綴的結果，已到期的手動封禁忽略
+func (this *ipTrie) lookup(addr netip.Addr, now time.Time) int8 {
+	node := this.v6
+	if addr.Is4() {
+		node = this.v4
+	}
+	var action int8
+	b := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if now.Before(node.ban) {
+			action = AccessDeny
+		} else if node.action != AccessNone {
+			action = node.action
+		}
+		if i == len(b)*8 {
+			break
+		}
+		node = node.child[b[i/8]>>(7-i%8)&1]
+	}
+	return action
+}
@@ -0,0 +1,193 @@
+package goweber
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAccesserCheck(t *testing.T) {
+	a := NewAccesser()
+	a.Allow = []string{"10.0.0.0/8", "2001:db8::/32"}
+	a.Deny = []string{"10.1.0.0/16", "192.0.2.7", "10.2.0.0/16", "2001:db8:bad::/48"}
+	a.Allow = append(a.Allow, "10.2.3.0/24")
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{"10.9.9.9", AccessAllow},
+		{"10.1.2.3", AccessDeny},  // 更長的拒絕前綴優先
+		{"10.2.3.4", AccessAllow}, // 更長的允許前綴優先
+		{"10.2.4.4", AccessDeny},
+		{"192.0.2.7", AccessDeny},
+		{"192.0.2.8", AccessNone},
+		{"::ffff:10.1.0.1", AccessDeny},
+		{"2001:db8::1", AccessAllow},
+		{"2001:db8:bad::1", AccessDeny},
+		{"2001:db9::1", AccessNone},
+		{"bogus", AccessNone},
+	}
+	for _, tt := range tests {
+		if got := a.Check(tt.ip); got != tt.want {
+			t.Errorf("%s: got %d want %d", tt.ip, got, tt.want)
+		}
+	}
+	// 相同前綴拒絕優先
+	a.Allow = []string{"203.0.113.0/24"}
+	a.Deny = []string{"203.0.113.0/24"}
+	a.Load()
+	if a.Check("203.0.113.1") != AccessDeny {
+		t.Fatal("deny should win on equal prefix")
+	}
+	a.Deny = []string{"not-a-cidr"}
+	if err := a.Load(); err == nil || a.Check("203.0.113.1") != AccessDeny {
+		t.Fatal("bad list replaced the old one")
+	}
+	var none *Accesser
+	if none.Check("1.2.3.4") != AccessNone {
+		t.Fatal("nil accesser")
+	}
+}
+
+func TestAccesserFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deny.txt")
+	os.WriteFile(file, []byte("# bad networks\n198.51.100.0/24\n\n203.0.113.5 # single\n"), 0600)
+	a := NewAccesser()
+	a.DenyFiles = []string{file}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Check("198.51.100.9") != AccessDeny || a.Check("203.0.113.5") != AccessDeny || a.Check("203.0.113.6") != AccessNone {
+		t.Fatal("file list not applied")
+	}
+	var reloaded string
+	a.OnReload = func(file string, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reloaded = file
+	}
+	os.WriteFile(file, []byte("203.0.113.6\n"), 0600)
+	os.Chtimes(file, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	a.reload()
+	if reloaded != file || a.Check("198.51.100.9") != AccessNone || a.Check("203.0.113.6") != AccessDeny {
+		t.Fatal("changed file not reloaded")
+	}
+}
+
+func TestAccessServe(t *testing.T) {
+	app := newTestApp(t)
+	app.Accesser.Allow = []string{"192.0.2.0/24"}
+	app.Accesser.Deny = []string{"198.51.100.0/24"}
+	if err := app.Accesser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	app.rate.SetStart(1)
+	app.rate.Second = 60
+	app.rate.ErrMax = 2
+	app.Get("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	from := func(ip string) http.Header {
+		return http.Header{"X-Forwarded-For": {ip}}
+	}
+	app.Iper.Trusted, _ = ParseCIDRs("192.0.2.1") // httptest的連接地址
+	get := func(ip, target string) int {
+		return serve(app, "GET", target, from(ip)).Code
+	}
+	if code := get("198.51.100.1", "/ok"); code != http.StatusForbidden {
+		t.Fatalf("denied: %d", code)
+	}
+	// 允許名單不受404封禁
+	for i := 0; i < 5; i++ {
+		get("192.0.2.10", "/missing"+strconv.Itoa(i))
+		get("203.0.113.10", "/missing"+strconv.Itoa(i))
+	}
+	if code := get("192.0.2.10", "/ok"); code != http.StatusOK {
+		t.Fatalf("allowlisted: %d", code)
+	}
+	if code := get("203.0.113.10", "/ok"); code != http.StatusTooManyRequests {
+		t.Fatalf("not allowlisted: %d", code)
+	}
+}
+
+func TestAccesserBan(t *testing.T) {
+	a := NewAccesser()
+	a.Allow = []string{"192.0.2.0/24"}
+	a.Load()
+	if _, err := a.Ban("192.0.2.0/24", "test", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	a.Ban("2001:db8::/64", "test", 0)
+	if a.Check("192.0.2.1") != AccessDeny || a.Check("2001:db8::1") != AccessDeny || len(a.Bans()) != 2 {
+		t.Fatal("ban not applied")
+	}
+	// 到期後恢復靜態名單
+	time.Sleep(30 * time.Millisecond)
+	if a.Check("192.0.2.1") != AccessAllow || len(a.Bans()) != 1 {
+		t.Fatal("expired ban still applied")
+	}
+	if removed, _ := a.Unban("2001:db8::1"); len(removed) != 1 || a.Check("2001:db8::1") != AccessNone {
+		t.Fatal("unban by address failed")
+	}
+}
+
+func TestAccesserStore(t *testing.T) {
+	store := NewMemoryStore()
+	a, b := NewAccesser(), NewAccesser()
+	a.Store, b.Store = store, store
+	if _, err := a.Ban("192.0.2.0/24", "scanner", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Ban("198.51.100.1", "spam", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// 其他實例同步後生效
+	if b.Check("192.0.2.9") != AccessNone {
+		t.Fatal("banned before sync")
+	}
+	if err := b.SyncBans(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Check("192.0.2.9") != AccessDeny || b.Check("198.51.100.1") != AccessDeny {
+		t.Fatal("shared ban not applied")
+	}
+
+	// 永久封禁由快照保存，重啓後恢復
+	file := filepath.Join(t.TempDir(), "blocks.json")
+	if err := NewSnapshoter(file, store).Save(); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewAccesser()
+	restored.Store = NewMemoryStore()
+	if err := NewSnapshoter(file, restored.Store).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.SyncBans(); err != nil {
+		t.Fatal(err)
+	}
+	bans := restored.Bans()
+	if len(bans) != 2 || bans[0].Prefix != "192.0.2.0/24" || !bans[0].Until.IsZero() || bans[1].Until.IsZero() {
+		t.Fatalf("restored %+v", bans)
+	}
+
+	// 一個實例解封，其他實例同步後解除
+	removed, err := b.Unban("192.0.2.1")
+	if err != nil || len(removed) != 1 || removed[0].Reason != "store" {
+		t.Fatalf("unban %+v %v", removed, err)
+	}
+	if err := a.SyncBans(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Check("192.0.2.9") != AccessNone || a.Check("198.51.100.1") != AccessDeny {
+		t.Fatal("unban not shared")
+	}
+	// 本進程記錄的原因保留
+	if bans := a.Bans(); len(bans) != 1 || bans[0].Reason != "spam" {
+		t.Fatalf("bans %+v", bans)
+	}
+}
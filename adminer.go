@@ -0,0 +1,336 @@
+// * 封禁管理API
+// * 需Bearer令牌認證，返回JSON
+// * GET  {path}/bans   查看Rater、Bruter的監控和封禁列表、手動封禁及連接統計
+// * POST {path}/ban    手動封禁IP或CIDR {"ip":"192.0.2.0/24","reason":"scanner","ttl":3600}，ttl為0時永久，保存在Store中，多實例共用并由快照保存
+// *                    封禁覆蓋請求者自己的地址時拒絕，避免管理員把自己永久鎖在外面
+// * POST {path}/unban  解除與IP或CIDR重叠的全部封禁和計數 {"ip":"192.0.2.1"}
+package goweber
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Adminer 封禁管理，Admin掛載時Rater、Bruter、Accesser、Conner為空則使用Apper的
+// Adminer serves the ban management API
+type Adminer struct {
+	Token    string    // 認證令牌，為空時拒絕所有請求
+	Rater    *Rater    // 404封禁
+	Bruter   *Bruter   // 暴力破解封禁，nil為不管理
+	Accesser *Accesser // 手動封禁
+	Conner   *Conner   // 連接統計，nil為不顯示
+	Iper     *Iper     // 解析請求者地址，拒絕覆蓋該地址的封禁，nil時使用RemoteAddr
+	// 手動封禁和解封後調用，Admin掛載時為空則使用Apper.Audit
+	OnEvent func(ev BanEvent)
+}
+
+// 監控或封禁條目
+type adminEntry struct {
+	Key    string    `json:"key"` // IP、聚合前綴或Bruter的賬號、路由key
+	Count  int64     `json:"count,omitempty"`
+	Expire time.Time `json:"expire"`
+}
+
+type adminList struct {
+	Monitored []adminEntry `json:"monitored"`
+	Blocked   []adminEntry `json:"blocked"`
+}
+
+type adminRequest struct {
+	IP     string `json:"ip"`
+	Key    string `json:"key"` // 解封Bruter的賬號或路由key，如user:alice
+	Reason string `json:"reason"`
+	TTL    int    `json:"ttl"` // 秒
+}
+
+func NewAdminer(token string) *Adminer {
+	return &Adminer{Token: token}
+}
+
+// Admin 在path下注冊封禁管理路由，admin的Rater、Bruter、Accesser和Conner為空時使用Apper的
+// Admin mounts the ban management routes under path, using the Apper's Rater, Bruter, Accesser and Conner when not set
+func (this *Apper) Admin(path string, admin *Adminer) {
+	if admin.Rater == nil {
+		admin.Rater = this.rate
+	}
+	if admin.Bruter == nil {
+		admin.Bruter = this.bruter
+	}
+	if admin.Accesser == nil {
+		admin.Accesser = this.Accesser
+	}
+	if admin.Conner == nil {
+		admin.Conner = this.conner
+	}
+	if admin.Iper == nil {
+		admin.Iper = this.Iper
+	}
+	if admin.OnEvent == nil {
+		admin.OnEvent = this.Audit
+	}
+	g := this.Group(path, admin.Auth)
+	g.Get("/bans", admin.List)
+	g.Post("/ban", admin.Ban)
+	g.Post("/unban", admin.Unban)
+}
+
+// Auth 驗證Bearer令牌
+// Auth checks the bearer token
+func (this *Adminer) Auth(r *http.Request) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && this.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(this.Token)) == 1 {
+		return nil
+	}
+	if rw := GetResponser(r); rw != nil {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	}
+	return &HttpError{Code: http.StatusUnauthorized, Message: `{"error":"unauthorized"}`, ContentType: "application/json; charset=utf-8"}
+}
+
+// List 監控和封禁列表
+// List returns the monitored and blocked keys and the manual bans
+func (this *Adminer) List(w http.ResponseWriter, r *http.Request) {
+	res := map[string]any{}
+	var err error
+	if this.Rater != nil {
+		if res["rate"], err = listStore(this.Rater.Store, storeRateErr, storeRateBlock); err != nil {
+			adminError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+	if this.Bruter != nil {
+		if res["brute"], err = listStore(this.Bruter.Store, storeBruteErr, storeBruteBlock); err != nil {
+			adminError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+	if this.Accesser != nil {
+		res["bans"] = this.Accesser.Bans()
+	}
+	if this.Conner != nil {
+		res["conns"] = this.Conner.Stats()
+	}
+	adminJSON(w, http.StatusOK, res)
+}
+
+// Ban 手動封禁IP或CIDR
+// Ban manually bans an address or CIDR
+func (this *Adminer) Ban(w http.ResponseWriter, r *http.Request) {
+	req, err := readAdminRequest(w, r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.IP == "" {
+		adminError(w, http.StatusBadRequest, errors.New("ip is required"))
+		return
+	}
+	if req.TTL < 0 {
+		adminError(w, http.StatusBadRequest, errors.New("ttl must not be negative"))
+		return
+	}
+	p, err := parsePrefix(req.IP)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if addr, err := netip.ParseAddr(this.clientIP(r)); err == nil && p.Contains(addr.Unmap()) {
+		adminError(w, http.StatusBadRequest, errors.New("ban covers the requesting address"))
+		return
+	}
+	ban, err := this.Accesser.Ban(req.IP, req.Reason, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		adminError(w, http.StatusBadGateway, err)
+		return
+	}
+	this.event(BanEvent{Time: ban.Created, Event: EventBlock, Source: "admin", Key: ban.Prefix, Reason: ban.Reason, Until: ban.Until})
+	adminJSON(w, http.StatusOK, map[string]any{"ban": ban})
+}
+
+// Unban 解除與IP或CIDR重叠的手動封禁、Rater和Bruter的封禁及計數，或Bruter中指定key的封禁及計數
+// Unban removes manual bans, Rater and Bruter blocks and counters overlapping an address or CIDR, or those of one Bruter key
+func (this *Adminer) Unban(w http.ResponseWriter, r *http.Request) {
+	req, err := readAdminRequest(w, r)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	removed := 0
+	if req.Key != "" {
+		if removed, err = this.unbanKey(req.Key); err != nil {
+			adminError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+	if req.IP == "" {
+		adminJSON(w, http.StatusOK, map[string]any{"removed": removed})
+		return
+	}
+	p, err := parsePrefix(req.IP)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	bans, err := this.Accesser.Unban(req.IP)
+	for _, ban := range bans {
+		this.event(BanEvent{Time: time.Now(), Event: EventUnblock, Source: "admin", Key: ban.Prefix, Reason: req.Reason, Until: ban.Until})
+	}
+	if err != nil {
+		adminError(w, http.StatusBadGateway, err)
+		return
+	}
+	removed += len(bans)
+	// 封禁通過Unblock解除以調用OnUnblock，計數直接刪除
+	type target struct {
+		store  Store
+		prefix string
+		remove func(key string) error
+	}
+	var targets []target
+	if this.Rater != nil {
+		store := this.Rater.Store
+		unblock := func(key string) error { return this.Rater.Unblock(key, "admin") }
+		targets = append(targets, target{store, storeRateBlock, unblock},
+			target{store, storeRateErr, deleter(store, storeRateErr)}, target{store, storeRateEsc, deleter(store, storeRateEsc)})
+	}
+	if this.Bruter != nil {
+		store := this.Bruter.Store
+		unblock := func(key string) error { return this.Bruter.Unblock(key, "admin") }
+		targets = append(targets, target{store, storeBruteBlock, unblock},
+			target{store, storeBruteErr, deleter(store, storeBruteErr)}, target{store, storeBruteEsc, deleter(store, storeBruteEsc)},
+			target{store, storeBruteLevel, deleter(store, storeBruteLevel)})
+	}
+	for _, t := range targets {
+		n, err := unbanStore(t.store, t.prefix, p, t.remove)
+		removed += n
+		if err != nil {
+			adminError(w, http.StatusBadGateway, err)
+			return
+		}
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"removed": removed})
+}
+
+// 解除Bruter中一個key的封禁及計數，返回刪除的條目數
+func (this *Adminer) unbanKey(key string) (int, error) {
+	if this.Bruter == nil {
+		return 0, nil
+	}
+	store, n := this.Bruter.Store, 0
+	if _, ok, err := store.Get(storeBruteBlock + key); err != nil {
+		return n, err
+	} else if ok {
+		if err := this.Bruter.Unblock(key, "admin"); err != nil {
+			return n, err
+		}
+		n++
+	}
+	for _, prefix := range []string{storeBruteErr, storeBruteLevel} {
+		if _, ok, err := store.Get(prefix + key); err != nil {
+			return n, err
+		} else if ok {
+			if err := store.Delete(prefix + key); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 讀取Store中的監控和封禁列表，按key排序
+func listStore(store Store, errPrefix, blockPrefix string) (adminList, error) {
+	res := adminList{Monitored: []adminEntry{}, Blocked: []adminEntry{}}
+	for _, list := range []struct {
+		prefix string
+		to     *[]adminEntry
+	}{{errPrefix, &res.Monitored}, {blockPrefix, &res.Blocked}} {
+		entries, err := store.List(list.prefix)
+		if err != nil {
+			return res, err
+		}
+		for _, e := range entries {
+			entry := adminEntry{Key: strings.TrimPrefix(e.Key, list.prefix), Expire: e.Expire}
+			if list.prefix == errPrefix {
+				entry.Count = e.Value
+			}
+			*list.to = append(*list.to, entry)
+		}
+		sort.Slice(*list.to, func(i, j int) bool { return (*list.to)[i].Key < (*list.to)[j].Key })
+	}
+	return res, nil
+}
+
+// 對key與p重叠的條目調用remove，key不含前綴，路由key按其IP匹配，賬號key不匹配
+func unbanStore(store Store, prefix string, p netip.Prefix, remove func(key string) error) (int, error) {
+	entries, err := store.List(prefix)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		key := strings.TrimPrefix(e.Key, prefix)
+		kp, err := parsePrefix(bruteAddr(key))
+		if err != nil || !p.Overlaps(kp) {
+			continue
+		}
+		if err := remove(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func deleter(store Store, prefix string) func(key string) error {
+	return func(key string) error { return store.Delete(prefix + key) }
+}
+
+// 請求者地址
+func (this *Adminer) clientIP(r *http.Request) string {
+	if this.Iper != nil {
+		return this.Iper.GetClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (this *Adminer) event(ev BanEvent) {
+	if this.OnEvent != nil {
+		this.OnEvent(ev)
+	}
+}
+
+func readAdminRequest(w http.ResponseWriter, r *http.Request) (adminRequest, error) {
+	var req adminRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, err
+	}
+	if req.IP == "" && req.Key == "" {
+		return req, errors.New("ip or key is required")
+	}
+	return req, nil
+}
+
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,109 @@
+package goweber
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminer(t *testing.T) {
+	app := newTestApp(t)
+	app.rate.SetStart(1)
+	app.rate.Second = 60
+	app.rate.ErrMax = 1
+	app.Iper.Trusted, _ = ParseCIDRs("192.0.2.1")
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.Store = app.GetStore()
+	admin := NewAdminer("secret")
+	admin.Bruter = bruter
+	app.Admin("/admin", admin)
+	app.Get("/ok", func(w http.ResponseWriter, r *http.Request) {})
+
+	call := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-Forwarded-For", "203.0.113.250")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+	if w := call("GET", "/admin/bans", "", ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("no token: %d", w.Code)
+	}
+	if w := call("GET", "/admin/bans", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", w.Code)
+	}
+
+	// 404封禁和暴力破解封禁
+	serve(app, "GET", "/missing", http.Header{"X-Forwarded-For": {"198.51.100.7"}})
+	bruter.MaxErr = 1
+	bruter.SetStatus("198.51.100.8")
+	w := call("GET", "/admin/bans", "secret", "")
+	var list struct {
+		Rate  adminList   `json:"rate"`
+		Brute adminList   `json:"brute"`
+		Bans  []AccessBan `json:"bans"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != 200 {
+		t.Fatalf("list %d %s", w.Code, w.Body)
+	}
+	if len(list.Rate.Blocked) != 1 || list.Rate.Blocked[0].Key != "198.51.100.7" || len(list.Brute.Blocked) != 1 {
+		t.Fatalf("list %s", w.Body)
+	}
+
+	// 手動封禁CIDR
+	if w := call("POST", "/admin/ban", "secret", `{"ip":"192.0.2.0/28","reason":"scanner","ttl":3600}`); w.Code != 200 {
+		t.Fatalf("ban %d %s", w.Code, w.Body)
+	}
+	from := func(ip string) http.Header { return http.Header{"X-Forwarded-For": {ip}} }
+	if w := serve(app, "GET", "/ok", from("192.0.2.9")); w.Code != http.StatusForbidden {
+		t.Fatalf("banned cidr: %d", w.Code)
+	}
+	if w := call("POST", "/admin/ban", "secret", `{"ip":"bogus"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad ip: %d", w.Code)
+	}
+	// 覆蓋管理員自己地址的封禁被拒絕
+	for _, ip := range []string{"203.0.113.250", "203.0.113.0/24", "0.0.0.0/0"} {
+		if w := call("POST", "/admin/ban", "secret", `{"ip":"`+ip+`"}`); w.Code != http.StatusBadRequest {
+			t.Fatalf("self ban %s: %d", ip, w.Code)
+		}
+	}
+	if w := call("GET", "/admin/bans", "secret", ""); w.Code != 200 {
+		t.Fatalf("admin locked out: %d", w.Code)
+	}
+
+	// 解封覆蓋所有封禁，包括Bruter的重複封禁次數
+	w = call("POST", "/admin/unban", "secret", `{"ip":"0.0.0.0/0"}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"removed":4`) {
+		t.Fatalf("unban %d %s", w.Code, w.Body)
+	}
+	for _, ip := range []string{"192.0.2.9", "198.51.100.7"} {
+		if w := serve(app, "GET", "/ok", from(ip)); w.Code != 200 {
+			t.Fatalf("%s after unban: %d", ip, w.Code)
+		}
+	}
+	if bruter.IsBlocked("198.51.100.8") {
+		t.Fatal("bruter block not removed")
+	}
+
+	// 路由key按IP解封，賬號key按key解封
+	bruter.RouteErr, bruter.UserErr = 1, 1
+	bruter.SetStatus(BruteRoute("198.51.100.9", "/login"), BruteUser("alice"))
+	if w := call("POST", "/admin/unban", "secret", `{"ip":"198.51.100.9"}`); !strings.Contains(w.Body.String(), `"removed":2`) {
+		t.Fatalf("unban route %d %s", w.Code, w.Body)
+	}
+	if w := call("POST", "/admin/unban", "secret", `{"key":"user:alice"}`); !strings.Contains(w.Body.String(), `"removed":2`) {
+		t.Fatalf("unban key %d %s", w.Code, w.Body)
+	}
+	if len(bruter.Blocked()) != 0 {
+		t.Fatalf("blocked %v", bruter.Blocked())
+	}
+	if w := call("POST", "/admin/ban", "secret", `{"key":"user:bob"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("ban without ip: %d", w.Code)
+	}
+}
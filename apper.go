@@ -1,13 +1,16 @@
 package goweber
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,6 +18,26 @@ import (
 // Middleware type
 type MiddlewareFunc func(r *http.Request) error
 
+// HttpError 帶狀態碼的錯誤，中間件返回時按該狀態碼響應，其他錯誤為500
+// HttpError carries a status code, middleware returning it responds with that code instead of 500
+type HttpError struct {
+	Code    int
+	Message string
+	// 响应内容类型，为空时为text/plain
+	// Response content type, text/plain when empty
+	ContentType string
+}
+
+// NewHttpError 創建帶狀態碼的錯誤
+// NewHttpError creates an error with a status code
+func NewHttpError(code int, message string) *HttpError {
+	return &HttpError{Code: code, Message: message}
+}
+
+func (this *HttpError) Error() string {
+	return this.Message
+}
+
 // Apper 是应用程序的主结构体，包含路由映射、配置信息、端口、日志等信息
 // Apper is the main struct of the application, containing route mappings, configuration information, port, logs, etc.
 type Apper struct {
@@ -24,12 +47,28 @@ type Apper struct {
 	// 配置信息结构体指针
 	// Configuration information struct pointer
 	Config *Configer
+	// 客户端IP解析器，可赋值给Bruter共用
+	// Client IP resolver, can be shared with Bruter
+	Iper *Iper
+	// 访问控制名单，可赋值给Bruter共用
+	// Access allow/deny lists, can be shared with Bruter
+	Accesser *Accesser
+	// 地址聚合，nil为按单个地址计数和封禁，可赋值给Bruter共用
+	// Address aggregation, nil counts and blocks per address, can be shared with Bruter
+	Prefixer *Prefixer
+	// 处理请求时panic后调用，可用于上报错误，stack为调用栈
+	// Called after a panic while handling a request, e.g. for error reporting, stack is the stack trace
+	OnPanic func(r *http.Request, err any, stack []byte)
 	// 服务器监听端口
 	// Server listening port
 	port string
 	// 用于传递日志消息的通道
 	// Channel used to pass log messages
 	msg chan string
+	// msg关闭后notify不再写入
+	// Guards notify against sending on the closed msg channel
+	msgMu     sync.RWMutex
+	msgClosed bool
 	// 日志文件句柄
 	// Log file handle
 	logfile *os.File
@@ -59,6 +98,63 @@ type Apper struct {
 	// mu sync.Mutex 
 	// * 限流器 v1.1.0
 	rate *Rater
+	// 命名限流策略
+	// Named rate limit policies
+	policies map[string]*RatePolicy
+	// 429响应内容，为空时为Too Many Requests纯文本
+	// 429 response body, plain Too Many Requests when empty
+	rateBody string
+	// 500响应内容，为空时为Internal Server Error纯文本
+	// 500 response body, plain Internal Server Error when empty
+	panicBody string
+	// TLS配置
+	// TLS configuration
+	tls *Tlser
+	// Run是否支持h2c(明文HTTP/2)
+	// Whether Run serves h2c (cleartext HTTP/2)
+	h2c bool
+	// HTTP/2参数
+	// HTTP/2 parameters
+	http2 *http.HTTP2Config
+	// PROXY协议解析，nil为不启用
+	// PROXY protocol parser, nil when disabled
+	proxy *Proxyer
+	// 限流计数和封禁列表存储，可赋值给Bruter共用
+	// Storage of rate counters and block lists, can be shared with Bruter
+	store Store
+	// 封禁列表快照，nil为不启用
+	// Block list snapshots, nil when disabled
+	snapshot *Snapshoter
+	// 封禁管理API，nil为不启用
+	// Ban management API, nil when disabled
+	admin *Adminer
+	// 安全审计日志，nil为不启用
+	// Security audit log, nil when disabled
+	auditer *Auditer
+	// 封禁事件通知，nil为不启用
+	// Ban event webhook, nil when disabled
+	webhook *Webhooker
+	// 暴力破解防护，与限流共用IP解析、访问控制、存储、地址聚合和审计
+	// Brute force protection, sharing IP resolution, access lists, storage, aggregation and auditing with rate limiting
+	bruter *Bruter
+	// 行为监控，nil为不启用
+	// Behaviour monitoring, nil when disabled
+	behave *Behaver
+	// Web应用防火墙，nil为不启用
+	// Web application firewall, nil when disabled
+	waf *Wafer
+	// 蜜罐和慢速响应，nil为不启用
+	// Honeypot paths and tarpitting, nil when disabled
+	honey *Honeyer
+	// 请求大小限制
+	// Request size limits
+	sizer *Sizer
+	// 全局并发限制，nil为不启用
+	// Global concurrency limit, nil when disabled
+	concur *Concurrer
+	// 连接数限制，nil为不启用
+	// Connection limits at the listener, nil when disabled
+	conner *Conner
 }
 
 // New 创建并初始化一个新的Apper实例
@@ -73,13 +169,35 @@ func New() *Apper {
 		Config: &Configer{
 			params: make(map[string]map[string]string),
 		},
-		msg: make(chan string),
+		msg: make(chan string, 1024),
+		Iper: NewIper(),
+		Accesser: NewAccesser(),
 		rate: NewRater(),
+		policies: make(map[string]*RatePolicy),
+		tls:  NewTlser(),
+		sizer: NewSizer(),
+		http2: &http.HTTP2Config{},
 	}
 	app.SetConfig()
 	app.SetLog()
 	app.SetPort()
+	app.SetSizer()
+	app.SetIp()
+	app.SetAccess()
+	app.SetStore()
+	app.SetAudit()
+	app.SetPrefix()
 	app.SetRate()
+	app.SetBruter()
+	app.SetBehave()
+	app.SetConcurrency()
+	app.SetWaf()
+	app.SetHoney()
+	app.SetConn()
+	app.SetTLS()
+	app.SetHTTP2()
+	app.SetProxy()
+	app.SetAdmin()
 	return app
 }
 
@@ -91,19 +209,84 @@ func (this *Apper) Print(key string) {
 		fmt.Println(this.rate)
 	case "port":
 		fmt.Println(this.port)
+	case "tls":
+		fmt.Println(this.tls)
+	case "http2":
+		fmt.Println(this.h2c, this.http2)
+	case "proxy":
+		fmt.Println(this.proxy)
+	case "access":
+		fmt.Println(this.Accesser)
+	case "aggregate":
+		fmt.Println(this.Prefixer)
+	case "audit":
+		fmt.Println(this.auditer != nil, this.webhook)
+	case "store":
+		fmt.Println(this.store, this.snapshot)
+	case "bruter":
+		fmt.Println(this.bruter)
+	case "behave":
+		fmt.Println(this.behave)
+	case "waf":
+		fmt.Println(this.waf)
+	case "honey":
+		fmt.Println(this.honey)
+	case "size":
+		fmt.Println(this.sizer)
+	case "concurrency":
+		fmt.Println(this.concur)
+	case "conn":
+		fmt.Println(this.conner)
 	}
 }
 
 // Close 关闭应用程序资源，包括日志文件和消息通道
 // Close closes application resources, including log file and message channel
 func (this *Apper) Close() {
+	this.tls.Close()
+	this.Accesser.Close()
+	this.rate.Close()
+	if this.bruter != nil {
+		this.bruter.Close()
+	}
+	if this.behave != nil {
+		this.behave.Close()
+	}
+	if this.webhook != nil {
+		this.webhook.Close()
+	}
+	if this.auditer != nil {
+		this.auditer.Close()
+	}
+	if this.snapshot != nil {
+		if err := this.snapshot.Close(); err != nil && this.log != nil {
+			this.log.Println("snapshot " + this.snapshot.File + " failed: " + err.Error())
+		}
+	}
+	this.store.Close()
 	if this.logfile != nil {
-		err:=this.logfile.Close()
-		if err != nil {
-			panic(err)
+		if err := this.logfile.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "log close failed:", err)
 		}
 	}
+	this.msgMu.Lock()
+	this.msgClosed = true
 	close(this.msg)
+	this.msgMu.Unlock()
+}
+
+// notify 写入日志消息，不阻塞：通道已满时丢弃，Close后忽略，用于后台协程和回调
+// notify queues a log message without blocking, dropping it when the channel is full and ignoring it after Close, for background goroutines and hooks
+func (this *Apper) notify(msg string) {
+	this.msgMu.RLock()
+	defer this.msgMu.RUnlock()
+	if this.msgClosed {
+		return
+	}
+	select {
+	case this.msg <- msg:
+	default:
+	}
 }
 
 // SetConfig 从config.ini文件中读取配置信息
@@ -136,6 +319,7 @@ func (this *Apper) SetLog() {
 		this.logfile = logfile
 		this.log = log.New(logfile, "", log.LstdFlags)
 	}
+	this.panicBody = this.Config.Get("server", "panicbody") // 500響應內容
 	logmax := this.Config.Get("server", "logmax")
 	if logmax != "" {
 		ilogmax, err:= strconv.ParseInt(logmax, 10, 64)
@@ -154,6 +338,247 @@ func (this *Apper) SetPort() {
 	}
 }
 
+// SetSizer 从配置中设置请求体、请求头、查询字符串和multipart部分数的限制
+// SetSizer sets the body, header, query string and multipart part limits from configuration
+func (this *Apper) SetSizer() {
+	if this.Config.Get("server", "maxbody") != "" {
+		maxbody, err := strconv.ParseInt(this.Config.Get("server", "maxbody"), 10, 64) // 請求體最大字節數
+		if err != nil {
+			panic(err)
+		}
+		this.sizer.MaxBody = maxbody
+	}
+	params := map[string]*int{
+		"maxheaders":     &this.sizer.MaxHeaders,     // 請求頭最大數量
+		"maxheaderbytes": &this.sizer.MaxHeaderBytes, // 請求頭總字節數
+		"maxquery":       &this.sizer.MaxQuery,       // 查詢字符串最大長度
+		"maxparts":       &this.sizer.MaxParts,       // multipart最大部分數
+	}
+	for key, val := range params {
+		if this.Config.Get("server", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("server", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+}
+
+// BodyLimit 设置路径的请求体限制，覆盖[server] maxbody，0为不限制
+// BodyLimit sets the body limit of a path, overriding [server] maxbody, 0 means unlimited
+func (this *Apper) BodyLimit(path string, n int64) {
+	this.sizer.SetBody(path, n)
+}
+
+// SetIp 从配置中设置客户端IP解析策略和可信代理
+// SetIp sets the client IP strategy and trusted proxies from configuration
+func (this *Apper) SetIp() {
+	trusted, err := ParseCIDRs(this.Config.Get("ip", "trusted")) // 可信代理
+	if err != nil {
+		panic(err)
+	}
+	this.Iper.Trusted = trusted
+	if this.Config.Get("ip", "strategy") != "" {
+		strategy := this.Config.Get("ip", "strategy") // remote,xff,forwarded,realip,header
+		switch strategy {
+		case IpRemote, IpXff, IpForwarded, IpRealIp, IpHeader:
+		default:
+			panic("ip配置strategy不支持:" + strategy)
+		}
+		this.Iper.Strategy = strategy
+	}
+	this.Iper.Header = this.Config.Get("ip", "header")
+	if this.Iper.Strategy == IpHeader && this.Iper.Header == "" {
+		panic("ip配置strategy為header時header不能為空")
+	}
+}
+
+// SetAccess 从配置中设置访问控制名单，拒绝名单返回403，允许名单不受限流和暴力破解封禁
+// SetAccess sets the access lists from configuration, denied addresses get 403, allowed addresses are exempt from rate limiting and brute force bans
+func (this *Apper) SetAccess() {
+	this.Accesser.Allow = splitList(this.Config.Get("access", "allow"))           // 允許的CIDR
+	this.Accesser.Deny = splitList(this.Config.Get("access", "deny"))             // 拒絕的CIDR
+	this.Accesser.AllowFiles = splitList(this.Config.Get("access", "allowfile")) // 允許名單文件
+	this.Accesser.DenyFiles = splitList(this.Config.Get("access", "denyfile"))   // 拒絕名單文件
+	if this.Config.Get("access", "reload") != "" {
+		reload, err := strconv.Atoi(this.Config.Get("access", "reload")) // 檢查文件變更間隔秒
+		if err != nil {
+			panic(err)
+		}
+		this.Accesser.Reload = reload
+	}
+	if err := this.Accesser.Load(); err != nil {
+		panic(err)
+	}
+	this.Accesser.OnReload = func(file string, err error) {
+		if err != nil {
+			this.notify("access reload " + file + " failed: " + err.Error())
+			return
+		}
+		this.notify("access reload " + file)
+	}
+}
+
+// SetAudit 从配置中设置封禁事件的审计日志和通知，Bruter可共用：bruter.OnBlock = app.Audit
+// SetAudit sets up the audit log and webhook for ban events from configuration, Bruter can share them: bruter.OnBlock = app.Audit
+func (this *Apper) SetAudit() {
+	if this.Config.Get("audit", "file") != "" {
+		auditer, err := NewAuditer(this.Config.Get("audit", "file")) // 審計日志文件
+		if err != nil {
+			panic(err)
+		}
+		this.auditer = auditer
+	}
+	if this.Config.Get("audit", "webhook") != "" {
+		this.webhook = NewWebhooker(this.Config.Get("audit", "webhook")) // 通知地址
+		if this.Config.Get("audit", "retries") != "" {
+			retries, err := strconv.Atoi(this.Config.Get("audit", "retries")) // 重試次數
+			if err != nil {
+				panic(err)
+			}
+			this.webhook.Retries = retries
+		}
+		if this.Config.Get("audit", "timeout") != "" {
+			timeout, err := strconv.Atoi(this.Config.Get("audit", "timeout")) // 超時秒
+			if err != nil {
+				panic(err)
+			}
+			this.webhook.Timeout = time.Duration(timeout) * time.Second
+		}
+		if this.Config.Get("audit", "token") != "" {
+			this.webhook.Header = map[string]string{"Authorization": "Bearer " + this.Config.Get("audit", "token")}
+		}
+		this.webhook.OnError = func(ev BanEvent, err error) {
+			this.notify("webhook " + ev.Event + " " + ev.Key + " failed: " + err.Error())
+		}
+		this.webhook.Start()
+	}
+	this.rate.OnBlock = this.Audit
+	this.rate.OnUnblock = this.Audit
+}
+
+// Audit 记录封禁事件：写入访问日志、审计日志并发送通知
+// Audit records a ban event in the access log and audit log and sends it to the webhook
+func (this *Apper) Audit(ev BanEvent) {
+	line := ev.Source + " " + ev.Event + " " + ev.Key + " " + ev.Reason
+	if !ev.Until.IsZero() && ev.Event == EventBlock {
+		line += " until " + ev.Until.Format(time.RFC3339)
+	}
+	this.notify(line)
+	if this.auditer != nil {
+		if err := this.auditer.Write(ev); err != nil {
+			this.notify("audit log failed: " + err.Error())
+		}
+	}
+	if this.webhook != nil && !this.webhook.Notify(ev) {
+		this.notify("webhook queue full, dropped " + ev.Event + " " + ev.Key)
+	}
+}
+
+// SetPrefix 从配置中设置地址聚合，IPv6按前缀计数和封禁，同一前缀多个地址被封禁时升级封禁整个前缀
+// SetPrefix sets address aggregation from configuration, IPv6 is counted and blocked per prefix, escalating to a wider prefix when several keys in it are banned
+func (this *Apper) SetPrefix() {
+	if this.Config.Get("aggregate", "enable") != "1" {
+		return
+	}
+	this.Prefixer = NewPrefixer()
+	params := map[string]*int{
+		"ipv4":       &this.Prefixer.IPv4,         // IPv4前綴長度
+		"ipv6":       &this.Prefixer.IPv6,         // IPv6前綴長度
+		"escalate":   &this.Prefixer.Escalate,     // 升級所需封禁數量
+		"escalatev4": &this.Prefixer.EscalateIPv4, // IPv4升級前綴長度
+		"escalatev6": &this.Prefixer.EscalateIPv6, // IPv6升級前綴長度
+	}
+	for key, val := range params {
+		if this.Config.Get("aggregate", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("aggregate", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	if this.Prefixer.IPv4 < 0 || this.Prefixer.IPv4 > 32 || this.Prefixer.IPv6 < 0 || this.Prefixer.IPv6 > 128 {
+		panic("aggregate配置前綴長度錯誤")
+	}
+	this.rate.Prefixer = this.Prefixer
+}
+
+// SetStore 从配置中设置计数存储，默认为进程内存储，多实例部署时使用redis共享
+// SetStore sets the counter storage from configuration, in-process by default, redis shares counters between instances
+func (this *Apper) SetStore() {
+	switch this.Config.Get("store", "type") {
+	case "", "memory":
+		this.store = NewMemoryStore()
+	case "redis":
+		addr := this.Config.Get("store", "addr")
+		if addr == "" {
+			addr = "127.0.0.1:6379"
+		}
+		rediser := NewRediser(addr)
+		rediser.Password = this.Config.Get("store", "password")
+		if this.Config.Get("store", "prefix") != "" {
+			rediser.Prefix = this.Config.Get("store", "prefix")
+		}
+		params := map[string]*int{
+			"db":      &rediser.DB,      // 數據庫編號
+			"timeout": &rediser.Timeout, // 超時秒
+			"maxidle": &rediser.MaxIdle, // 最大空閑連接
+		}
+		for key, val := range params {
+			if this.Config.Get("store", key) != "" {
+				v, err := strconv.Atoi(this.Config.Get("store", key))
+				if err != nil {
+					panic(err)
+				}
+				*val = v
+			}
+		}
+		this.store = rediser
+	default:
+		panic("store配置type不支持:" + this.Config.Get("store", "type"))
+	}
+	this.rate.Store = this.store
+	this.rate.OnError = func(err error) {
+		this.notify("store error: " + err.Error())
+	}
+	// * 封禁列表快照，啓動時加載，定時及關閉時保存
+	// * Block list snapshot, loaded at startup, saved periodically and on Close
+	if this.Config.Get("store", "snapshot") != "" {
+		this.snapshot = NewSnapshoter(this.Config.Get("store", "snapshot"), this.store)
+		if this.Config.Get("store", "interval") != "" {
+			interval, err := strconv.Atoi(this.Config.Get("store", "interval")) // 保存間隔秒
+			if err != nil {
+				panic(err)
+			}
+			this.snapshot.Interval = interval
+		}
+		if err := this.snapshot.Load(); err != nil {
+			panic("加載封禁快照" + this.snapshot.File + "失敗:" + err.Error())
+		}
+		this.snapshot.OnError = func(err error) {
+			this.notify("snapshot " + this.snapshot.File + " failed: " + err.Error())
+		}
+		go this.snapshot.Run()
+	}
+	// * 手動封禁保存在store中，從快照或其他實例恢復，每隔[access] reload秒同步
+	// * Manual bans are kept in the store, restored from the snapshot or other instances and synced every [access] reload seconds
+	this.Accesser.Store = this.store
+	if err := this.Accesser.SyncBans(); err != nil {
+		fmt.Fprintln(os.Stderr, "access sync failed:", err)
+	}
+	if this.Accesser.Reload > 0 {
+		go this.Accesser.Watch()
+	}
+}
+
+// GetStore 获取计数存储，Bruter可共用：bruter.Store = app.GetStore()
+// GetStore returns the counter storage, Bruter can share it: bruter.Store = app.GetStore()
+func (this *Apper) GetStore() Store {
+	return this.store
+}
+
 // SetLimit 設置限流
 // SetLimit set rate limiting
 func (this *Apper) SetRate() {
@@ -162,7 +587,7 @@ func (this *Apper) SetRate() {
 		if err != nil {
 			panic(err)
 		}
-		this.rate.Start = start
+		this.rate.SetStart(start)
 	}
 	if this.Config.Get("rate", "second") != "" {
 	    second,err := strconv.Atoi(this.Config.Get("rate", "second")) // 每秒允許請求次數
@@ -192,31 +617,634 @@ func (this *Apper) SetRate() {
 		}
 		this.rate.BlockMinute = blockminute
 	}
+	// * 請求限流，與404封禁相互獨立
+	// * Request rate limiting, independent from the 404 ban
+	if this.Config.Get("rate", "limit") != "" {
+		limit, err := strconv.Atoi(this.Config.Get("rate", "limit")) // 0 禁用 1 啟用
+		if err != nil {
+			panic(err)
+		}
+		this.rate.Limit = limit
+	}
+	if this.Config.Get("rate", "algorithm") != "" {
+		this.rate.Algorithm = this.Config.Get("rate", "algorithm") // token,fixed,sliding
+	}
+	params := map[string]*int{
+		"rate":   &this.rate.Rate,   // 窗口内允許請求數
+		"window": &this.rate.Window, // 窗口秒
+		"burst":  &this.rate.Burst,  // 令牌桶容量
+	}
+	for key, val := range params {
+		if this.Config.Get("rate", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("rate", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	if this.rate.Limit == 1 {
+		if err := this.rate.SetLimiter(); err != nil {
+			panic(err)
+		}
+	}
+	// 429響應内容，JSON格式
+	this.rateBody = this.Config.Get("rate", "body")
+	this.SetPolicy()
 }
 
-// GetClientIP 获取客户端真实IP地址
-// GetClientIP get client real IP address
-func (this *Apper) GetClientIP(r *http.Request) string {
-	// 优先从X-Forwarded-For头获取IP
-	// Prioritize getting IP from X-Forwarded-For header
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		// 如果X-Forwarded-For为空，则尝试从X-Real-IP头获取
-		// If X-Forwarded-For is empty, try to get from X-Real-IP header
-		ip = r.Header.Get("X-Real-IP")
-	}
-	// 如果两个头都没有值，则使用RemoteAddr
-	// If both headers have no value, use RemoteAddr
-	if ip == "" {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+// SetBruter 从配置中设置暴力破解防护，封禁时长按lockout逐次递增
+// SetBruter sets up brute force protection from configuration, lockouts grow with each repeat offence
+func (this *Apper) SetBruter() {
+	this.bruter = NewBruter()
+	this.bruter.Iper = this.Iper
+	this.bruter.Accesser = this.Accesser
+	this.bruter.Store = this.store
+	this.bruter.Prefixer = this.Prefixer
+	this.bruter.OnBlock = this.Audit
+	this.bruter.OnUnblock = this.Audit
+	this.bruter.OnError = this.rate.OnError
+	this.bruter.Body = this.rateBody
+	params := map[string]*int{
+		"maxip":    &this.bruter.MaxIp,    // 監控key數量
+		"maxerr":   &this.bruter.MaxErr,   // 每個IP的錯誤數量
+		"usererr":  &this.bruter.UserErr,  // 每個賬號的錯誤數量，0為不按賬號
+		"routeerr": &this.bruter.RouteErr, // 每個IP每個路由的錯誤數量，0為不按路由
+		"maxtime":  &this.bruter.MaxTime,  // 監控時間秒
+	}
+	for key, val := range params {
+		if this.Config.Get("bruter", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("bruter", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	if this.Config.Get("bruter", "lockout") != "" {
+		this.bruter.Lockouts = nil
+		for _, s := range splitList(this.Config.Get("bruter", "lockout")) { // 逐次封禁時長，如1m,5m,1h,24h
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				panic("bruter配置lockout錯誤:" + s)
+			}
+			this.bruter.Lockouts = append(this.bruter.Lockouts, d)
+		}
+	}
+	durations := map[string]*time.Duration{
+		"forget":   &this.bruter.Forget,    // 重複封禁次數保留時間
+		"delay":    &this.bruter.DelayBase, // 首次失敗後的延遲
+		"delaymax": &this.bruter.DelayMax,  // 最大延遲
+	}
+	for key, val := range durations {
+		if this.Config.Get("bruter", key) != "" {
+			d, err := time.ParseDuration(this.Config.Get("bruter", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = d
+		}
+	}
+}
+
+// SetBehave 从配置中设置行为监控，目录扫描和等间隔请求写入限流的封禁列表
+// SetBehave sets up behaviour monitoring from configuration, directory scans and evenly timed requests are banned through the rate limiter
+func (this *Apper) SetBehave() {
+	if this.Config.Get("behave", "enable") != "1" {
+		return
+	}
+	this.behave = NewBehaver(this.rate)
+	params := map[string]*int{
+		"window":   &this.behave.Window,   // 監控周期秒
+		"notfound": &this.behave.NotFound, // 周期内404數量
+		"samples":  &this.behave.Samples,  // 判斷機器人的請求數
+		"block":    &this.behave.Block,    // 封禁秒
+		"ipmax":    &this.behave.MaxIp,    // 監控IP數量
+	}
+	for key, val := range params {
+		if this.Config.Get("behave", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("behave", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	durations := map[string]*time.Duration{
+		"interval": &this.behave.MinInterval, // 機器人請求的最小間隔
+		"jitter":   &this.behave.Jitter,      // 等間隔允許的誤差
+	}
+	for key, val := range durations {
+		if this.Config.Get("behave", key) != "" {
+			d, err := time.ParseDuration(this.Config.Get("behave", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = d
+		}
+	}
+	this.behave.Paths = splitList(this.Config.Get("behave", "paths"))   // 不檢查機器人的路徑前綴
+	this.behave.Agents = splitList(this.Config.Get("behave", "agents")) // 不檢查機器人的User-Agent
+}
+
+// SetConcurrency 从配置中设置全局并发限制，作为全局中间件，饱和时返回503
+// SetConcurrency sets the global concurrency limit from configuration as global middleware, returning 503 when saturated
+func (this *Apper) SetConcurrency() {
+	if this.Config.Get("concurrency", "enable") != "1" {
+		return
+	}
+	this.concur = NewConcurrer(256)
+	this.concur.Adaptive = this.Config.Get("concurrency", "adaptive") == "1" // 0 固定 1 自適應
+	params := map[string]*int{
+		"limit":      &this.concur.Limit,      // 最大並發數
+		"queue":      &this.concur.Queue,      // 等待隊列長度
+		"min":        &this.concur.MinLimit,   // 自適應最小並發數
+		"retryafter": &this.concur.RetryAfter, // Retry-After秒
+	}
+	for key, val := range params {
+		if this.Config.Get("concurrency", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("concurrency", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	if this.concur.Limit <= 0 {
+		panic("concurrency配置limit需大於0")
+	}
+	durations := map[string]*time.Duration{
+		"timeout": &this.concur.Timeout, // 排隊超時
+		"target":  &this.concur.Target,  // 自適應目標響應時間
+	}
+	for key, val := range durations {
+		if this.Config.Get("concurrency", key) != "" {
+			d, err := time.ParseDuration(this.Config.Get("concurrency", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = d
+		}
+	}
+	this.Use(this.concur.Check)
+}
+
+// SetConn 从配置中设置连接数限制，Run和RunTLS的监听器限制总连接数和每个IP的连接数并回收空闲连接
+// SetConn sets the connection limits from configuration, the listener of Run and RunTLS limits total and per-IP connections and reaps idle ones
+func (this *Apper) SetConn() {
+	if this.Config.Get("conn", "enable") != "1" {
+		return
+	}
+	this.conner = NewConner()
+	this.conner.Prefixer = this.Prefixer
+	this.conner.Accesser = this.Accesser
+	params := map[string]*int{
+		"max":   &this.conner.MaxConns, // 總連接數
+		"perip": &this.conner.MaxPerIP, // 每IP連接數
+	}
+	for key, val := range params {
+		if this.Config.Get("conn", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("conn", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	if this.Config.Get("conn", "idle") != "" {
+		d, err := time.ParseDuration(this.Config.Get("conn", "idle")) // 空閑超時
+		if err != nil {
+			panic(err)
+		}
+		this.conner.Idle = d
+	}
+	this.conner.OnReject = func(addr net.Addr, reason string) {
+		this.notify("conn " + addr.String() + " rejected: " + reason + " limit")
+	}
+}
+
+// GetConner 获取连接数限制，未启用时为nil
+// GetConner returns the connection limiter, nil when disabled
+func (this *Apper) GetConner() *Conner {
+	return this.conner
+}
+
+// SetWaf 从配置中设置Web应用防火墙，作为全局中间件检查所有请求
+// SetWaf sets up the web application firewall from configuration as global middleware for every request
+func (this *Apper) SetWaf() {
+	if this.Config.Get("waf", "enable") != "1" {
+		return
+	}
+	this.waf = NewWafer()
+	this.waf.Files = splitList(this.Config.Get("waf", "rules")) // 規則文件，為空時使用內置規則
+	switch this.Config.Get("waf", "mode") {
+	case "", "block":
+	case "detect":
+		this.waf.Detect = true // 只記錄不攔截
+	default:
+		panic("waf配置mode不支持:" + this.Config.Get("waf", "mode"))
+	}
+	if this.Config.Get("waf", "threshold") != "" {
+		threshold, err := strconv.Atoi(this.Config.Get("waf", "threshold")) // 攔截分數
+		if err != nil {
+			panic(err)
+		}
+		this.waf.Threshold = threshold
+	}
+	if this.Config.Get("waf", "body") != "" {
+		body, err := strconv.ParseInt(this.Config.Get("waf", "body"), 10, 64) // 檢查的請求體字節數
+		if err != nil {
+			panic(err)
+		}
+		this.waf.MaxBody = body
+	}
+	if err := this.waf.Load(); err != nil {
+		panic(err)
+	}
+	this.waf.OnMatch = func(r *http.Request, res WafResult) {
+		ids := make([]string, len(res.Matches))
+		for i, m := range res.Matches {
+			ids[i] = m.Rule.ID + ":" + m.Target
+		}
+		action := "waf log"
+		if res.Blocked && this.waf.Detect {
+			action = "waf detect"
+		} else if res.Blocked {
+			action = "waf block"
+		}
+		this.msg <- this.GetClientIP(r) + " " + r.Method + " " + r.URL.String() + " " + action + " score " + strconv.Itoa(res.Score) + " " + strings.Join(ids, ",")
+	}
+	this.Use(this.waf.Check)
+}
+
+// GetWafer 获取Web应用防火墙，未启用时返回nil，可再挂载到路由：app.Post("/api", h, waf.Check)
+// GetWafer returns the web application firewall, nil when disabled, it can also be mounted on routes: app.Post("/api", h, waf.Check)
+func (this *Apper) GetWafer() *Wafer {
+	return this.waf
+}
+
+// SetHoney 从配置中设置蜜罐路径，访问即封禁，可对已封禁的客户端慢速响应
+// SetHoney sets up honeypot paths from configuration, banning on access, optionally tarpitting banned clients
+func (this *Apper) SetHoney() {
+	if this.Config.Get("honey", "enable") != "1" {
+		return
+	}
+	this.honey = NewHoneyer(this.rate)
+	if this.Config.Get("honey", "paths") != "" {
+		this.honey.Paths = splitList(this.Config.Get("honey", "paths")) // 蜜罐路徑
+	}
+	this.honey.Tarpit = this.Config.Get("honey", "tarpit") == "1" // 0 禁用 1 啟用
+	params := map[string]*int{
+		"block": &this.honey.Block,     // 封禁秒
+		"max":   &this.honey.MaxTarpit, // 同時慢速響應的最大連接數
+	}
+	for key, val := range params {
+		if this.Config.Get("honey", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("honey", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	durations := map[string]*time.Duration{
+		"interval": &this.honey.Interval, // 每個字節的間隔
+		"duration": &this.honey.Duration, // 每個連接最長時間
+	}
+	for key, val := range durations {
+		if this.Config.Get("honey", key) != "" {
+			d, err := time.ParseDuration(this.Config.Get("honey", key))
+			if err != nil || d <= 0 {
+				panic("honey配置" + key + "錯誤:" + this.Config.Get("honey", key))
+			}
+			*val = d
+		}
+	}
+}
+
+// GetBruter 获取暴力破解防护：keys := bruter.Keys(r, user); bruter.SetStatus(keys...)
+// GetBruter returns the brute force protection: keys := bruter.Keys(r, user); bruter.SetStatus(keys...)
+func (this *Apper) GetBruter() *Bruter {
+	return this.bruter
+}
+
+// TooManyRequests 返回429错误，使用[rate] body配置的JSON响应内容
+// TooManyRequests returns the 429 error using the JSON body configured in [rate] body
+func (this *Apper) TooManyRequests() *HttpError {
+	if this.rateBody != "" {
+		return &HttpError{Code: http.StatusTooManyRequests, Message: this.rateBody, ContentType: "application/json; charset=utf-8"}
+	}
+	return NewHttpError(http.StatusTooManyRequests, "Too Many Requests")
+}
+
+// InternalServerError 返回500错误，使用[server] panicbody配置的JSON响应内容
+// InternalServerError returns the 500 error using the JSON body configured in [server] panicbody
+func (this *Apper) InternalServerError() *HttpError {
+	if this.panicBody != "" {
+		return &HttpError{Code: http.StatusInternalServerError, Message: this.panicBody, ContentType: "application/json; charset=utf-8"}
+	}
+	return NewHttpError(http.StatusInternalServerError, "Internal Server Error")
+}
+
+// recovery 恢复处理请求时的panic，记录请求和调用栈，调用OnPanic，未写入响应时返回500
+// recovery recovers a panic while handling a request, logs the request and stack trace, calls OnPanic and responds 500 unless already written
+func (this *Apper) recovery(rw *Responser, r *http.Request) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	// http.ErrAbortHandler用于中止响应，交由net/http处理
+	// http.ErrAbortHandler aborts the response and is left to net/http
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	stack := debug.Stack()
+	this.msg <- this.GetClientIP(r) + " " + r.Method + " " + r.URL.String() + " panic: " + fmt.Sprint(err) + "\n" + string(stack)
+	if this.OnPanic != nil {
+		this.OnPanic(r, err, stack)
+	}
+	if rw.Status == 0 {
+		this.Error(rw, this.InternalServerError())
+	}
+}
+
+// SetPolicy 从配置中读取限流策略，[rate]中policies列出策略名，每个策略在[rate.名称]中配置
+// SetPolicy reads rate policies listed in [rate] policies, each configured in its own [rate.name] section
+func (this *Apper) SetPolicy() {
+	for _, name := range splitList(this.Config.Get("rate", "policies")) {
+		title := "rate." + name
+		p := NewRatePolicy(name, this.Config.Get(title, "algorithm"), 0, 1)
+		params := map[string]*int{
+			"rate":   &p.Rate,   // 窗口内允許請求數
+			"window": &p.Window, // 窗口秒
+			"burst":  &p.Burst,  // 令牌桶容量
+			"block":  &p.Block,  // 超限封禁秒數
+			"ipmax":  &p.IpMax,  // 最大監控key數量
+		}
+		for key, val := range params {
+			if this.Config.Get(title, key) != "" {
+				v, err := strconv.Atoi(this.Config.Get(title, key))
+				if err != nil {
+					panic(err)
+				}
+				*val = v
+			}
+		}
+		if this.Config.Get(title, "key") != "" {
+			p.Key = this.Config.Get(title, "key") // ip,user,apikey,header:名稱
+		}
+		if err := this.Policy(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Policy 注册限流策略，同名策略会被替换
+// Policy registers a rate policy, replacing any policy with the same name
+func (this *Apper) Policy(p *RatePolicy) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+	this.policies[p.Name] = p
+	return nil
+}
+
+// RateLimit 返回按策略限流的中间件，可挂载到路由或路由组，策略不存在时panic
+// RateLimit returns middleware enforcing the named policy on routes or groups, panics when the policy is unknown
+func (this *Apper) RateLimit(name string) MiddlewareFunc {
+	p, ok := this.policies[name]
+	if !ok {
+		panic("限流策略不存在:" + name)
+	}
+	return func(r *http.Request) error {
+		ip := this.GetClientIP(r)
+		if this.Accesser.Check(ip) == AccessAllow {
+			return nil
+		}
+		res := p.TakeRequest(r, this.Prefixer.Key(ip)) // 按聚合前綴計數
+		if rw := GetResponser(r); rw != nil {
+			SetRateHeaders(rw.Header(), res)
+		}
+		if !res.Allowed {
+			return this.TooManyRequests()
+		}
+		return nil
+	}
+}
+
+// SetTLS 從配置中設置TLS參數
+// SetTLS sets TLS parameters from configuration
+func (this *Apper) SetTLS() {
+	if this.Config.Get("tls", "min") != "" {
+		min, err := ParseTlsVersion(this.Config.Get("tls", "min")) // 最低版本
+		if err != nil {
+			panic(err)
+		}
+		this.tls.MinVersion = min
+	}
+	if this.Config.Get("tls", "max") != "" {
+		max, err := ParseTlsVersion(this.Config.Get("tls", "max")) // 最高版本
+		if err != nil {
+			panic(err)
+		}
+		this.tls.MaxVersion = max
+	}
+	if this.Config.Get("tls", "ciphers") != "" {
+		ciphers, err := ParseCipherSuites(this.Config.Get("tls", "ciphers")) // 加密套件
+		if err != nil {
+			panic(err)
+		}
+		this.tls.CipherSuites = ciphers
+	}
+	if this.Config.Get("tls", "curves") != "" {
+		curves, err := ParseCurves(this.Config.Get("tls", "curves")) // 曲綫偏好
+		if err != nil {
+			panic(err)
+		}
+		this.tls.CurvePreferences = curves
+	}
+	// 多張證書按順序對應，SNI無法匹配時使用第一張
+	certs := splitList(this.Config.Get("tls", "cert"))
+	keys := splitList(this.Config.Get("tls", "key"))
+	if len(certs) != len(keys) {
+		panic("tls配置cert與key數量不一致")
+	}
+	for i := range certs {
+		this.tls.AddCert(certs[i], keys[i])
+	}
+	if this.Config.Get("tls", "reload") != "" {
+		reload, err := strconv.Atoi(this.Config.Get("tls", "reload")) // 證書檢查周期，秒
+		if err != nil {
+			panic(err)
+		}
+		this.tls.Reload = reload
+	}
+	if this.Config.Get("tls", "clientauth") != "" {
+		clientauth, err := ParseClientAuth(this.Config.Get("tls", "clientauth")) // 客戶端證書模式
+		if err != nil {
+			panic(err)
+		}
+		this.tls.ClientAuth = clientauth
+	}
+	this.tls.ClientCA = this.Config.Get("tls", "clientca")
+	this.tls.CRL = this.Config.Get("tls", "crl")
+	this.tls.OnReload = func(certFile string, err error) {
+		if err != nil {
+			this.notify("tls reload " + certFile + " failed: " + err.Error())
+			return
+		}
+		this.notify("tls reload " + certFile)
+	}
+}
+
+// SetHTTP2 从配置中设置h2c及HTTP/2参数
+// SetHTTP2 sets h2c and HTTP/2 parameters from configuration
+func (this *Apper) SetHTTP2() {
+	if this.Config.Get("http2", "h2c") != "" {
+		h2c, err := strconv.Atoi(this.Config.Get("http2", "h2c")) // 0 禁用 1 啟用
+		if err != nil {
+			panic(err)
+		}
+		this.h2c = h2c == 1
+	}
+	// 整數參數，0為使用默認值
+	params := map[string]*int{
+		"maxstreams":   &this.http2.MaxConcurrentStreams,          // 每個連接最大并發流
+		"maxframe":     &this.http2.MaxReadFrameSize,              // 最大讀取幀，16KB-16MB
+		"headertable":  &this.http2.MaxDecoderHeaderTableSize,     // 頭部壓縮表大小
+		"connbuffer":   &this.http2.MaxReceiveBufferPerConnection, // 每個連接接收窗口
+		"streambuffer": &this.http2.MaxReceiveBufferPerStream,     // 每個流接收窗口
+	}
+	for key, val := range params {
+		if this.Config.Get("http2", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("http2", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = v
+		}
+	}
+	// 時間參數，單位秒
+	durations := map[string]*time.Duration{
+		"pingsecond":   &this.http2.SendPingTimeout,  // 無數據時發送ping檢查的間隔
+		"pingtimeout":  &this.http2.PingTimeout,      // ping無響應關閉連接
+		"writetimeout": &this.http2.WriteByteTimeout, // 無法寫入數據關閉連接
+	}
+	for key, val := range durations {
+		if this.Config.Get("http2", key) != "" {
+			v, err := strconv.Atoi(this.Config.Get("http2", key))
+			if err != nil {
+				panic(err)
+			}
+			*val = time.Duration(v) * time.Second
+		}
+	}
+}
+
+// SetProxy 从配置中设置PROXY协议，只解析可信来源的连接
+// SetProxy sets up the PROXY protocol from configuration, only connections from trusted sources are parsed
+func (this *Apper) SetProxy() {
+	if this.Config.Get("proxy", "enable") != "1" {
+		return
+	}
+	trusted, err := ParseCIDRs(this.Config.Get("proxy", "trusted")) // 可信負載均衡地址
+	if err != nil {
+		panic(err)
+	}
+	if len(trusted) == 0 {
+		panic("proxy配置trusted不能為空")
+	}
+	this.proxy = NewProxyer(trusted)
+	if this.Config.Get("proxy", "timeout") != "" {
+		timeout, err := strconv.Atoi(this.Config.Get("proxy", "timeout")) // 讀取頭部超時，秒
 		if err != nil {
-			return "unknown" // 格式化错误，返回未知IP
-			// Formatting error, return unknown IP
+			panic(err)
+		}
+		this.proxy.Timeout = timeout
+	}
+}
+
+// SetAdmin 从配置中挂载封禁管理API，需设置令牌
+// SetAdmin mounts the ban management API from configuration, a token is required
+func (this *Apper) SetAdmin() {
+	if this.Config.Get("admin", "enable") != "1" {
+		return
+	}
+	token := this.Config.Get("admin", "token")
+	if token == "" {
+		panic("admin配置token不能為空")
+	}
+	path := this.Config.Get("admin", "path")
+	if path == "" {
+		path = "/admin"
+	}
+	this.admin = NewAdminer(token)
+	this.Admin(path, this.admin)
+}
+
+// GetAdminer 获取封禁管理API，未启用时返回nil
+// GetAdminer returns the ban management API, nil when disabled
+func (this *Apper) GetAdminer() *Adminer {
+	return this.admin
+}
+
+// GetClientIP 获取客户端真实IP地址，只信任[ip]中配置的代理
+// GetClientIP get client real IP address, forwarding headers are only trusted from proxies configured in [ip]
+func (this *Apper) GetClientIP(r *http.Request) string {
+	return this.Iper.GetClientIP(r)
+}
+
+// GetClientCert 获取客户端证书身份，未提供证书时返回nil
+// GetClientCert gets the client certificate identity, nil when no certificate was presented
+func (this *Apper) GetClientCert(r *http.Request) *CertIdentity {
+	return this.tls.Identity(r)
+}
+
+// RequireCert 要求客户端证书已验证，names不为空时CN或SAN需匹配其中之一
+// RequireCert requires a verified client certificate whose CN or SAN matches one of names when given
+func (this *Apper) RequireCert(names ...string) MiddlewareFunc {
+	return func(r *http.Request) error {
+		id := this.GetClientCert(r)
+		if id == nil || !id.Verified {
+			return NewHttpError(http.StatusUnauthorized, "client certificate required")
+		}
+		if len(names) == 0 {
+			return nil
 		}
-		return ip
+		for _, name := range id.Names() {
+			for _, allow := range names {
+				if name == allow {
+					return nil
+				}
+			}
+		}
+		return NewHttpError(http.StatusForbidden, "client certificate not allowed")
 	}
+}
 
-	return ip
+// Error 按错误类型响应，HttpError使用其状态码
+// Error responds according to the error, HttpError uses its own status code
+func (this *Apper) Error(w http.ResponseWriter, err error) {
+	var herr *HttpError
+	if errors.As(err, &herr) {
+		if herr.ContentType != "" {
+			w.Header().Set("Content-Type", herr.ContentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(herr.Code)
+			fmt.Fprintln(w, herr.Message)
+			return
+		}
+		http.Error(w, herr.Message, herr.Code)
+		return
+	}
+	// * 請求體超過限制
+	// * Request body over the limit
+	var merr *http.MaxBytesError
+	if errors.As(err, &merr) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
 // 全局中間件處理
@@ -263,34 +1291,30 @@ func (this *Apper) Route(method string, path string, f http.HandlerFunc, mid ...
 	this.rmap[method][path] = f
 }
 
+// registered 路径是否以任一方法注册
+// registered reports whether path is registered under any method
+func (this *Apper) registered(path string) bool {
+	for _, routes := range this.rmap {
+		if _, ok := routes[path]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Logger 处理日志记录，监听消息通道并将日志写入文件或控制台
 // Logger handles log recording, listens to the message channel and writes logs to file or console
 func (this *Apper) Logger() {
 	// fmt.Println("Logger")
 	for msg := range this.msg {
 		if this.log != nil {
-			info, err := this.logfile.Stat()
-			if err != nil {
-				panic(err)
-			}
-			if info.Size() > this.logmax && this.logmax > 0 {
-				//* 日志空間超過上綫，新增日志文件
-				//* Log space exceeds limit, create new log file
-				err=this.logfile.Close()
-				if err != nil {
-					panic(err)
-				}
-				infoname := info.Name()
-				err=os.Rename(infoname, infoname+strconv.FormatInt(time.Now().Unix(), 10))
-				if err != nil {
-					panic(err)
-				}
-				this.logfile, err = os.OpenFile(infoname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-				if err != nil {
-					panic(err)
-				}
-				this.log = log.New(this.logfile, "", log.LstdFlags)
+			if err := this.rotate(); err != nil {
+				// 日志文件出错时输出到标准错误，不中断服务
+				// Log file errors go to stderr without stopping the server
+				fmt.Fprintln(os.Stderr, "log rotate failed:", err)
 			}
+		}
+		if this.log != nil {
 			this.log.Println(msg)
 		} else {
 			fmt.Println(msg)
@@ -298,9 +1322,47 @@ func (this *Apper) Logger() {
 	}
 }
 
+// rotate 日志空间超过上限时新增日志文件，无法重新打开时改为输出到标准输出
+// rotate starts a new log file once the size limit is exceeded, falling back to stdout when it cannot be reopened
+func (this *Apper) rotate() error {
+	if this.logmax <= 0 {
+		return nil
+	}
+	info, err := this.logfile.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= this.logmax {
+		return nil
+	}
+	//* 日志空間超過上綫，新增日志文件
+	//* Log space exceeds limit, create new log file
+	name := this.logfile.Name()
+	this.logfile.Close()
+	renameErr := os.Rename(name, name+strconv.FormatInt(time.Now().Unix(), 10))
+	logfile, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		this.logfile, this.log = nil, nil
+		return err
+	}
+	this.logfile = logfile
+	this.log = log.New(this.logfile, "", log.LstdFlags)
+	return renameErr
+}
+
 // ServeHTTP 实现http.Handler接口，处理HTTP请求
 // ServeHTTP implements the http.Handler interface to handle HTTP requests
 func (this *Apper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// * 访问控制，在路由之前检查，拒绝名单直接返回403
+	// * Access control is checked before routing, denied addresses get 403
+	ipaddr := this.GetClientIP(r)
+	access := this.Accesser.Check(ipaddr)
+	if access == AccessDeny {
+		this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " access denied"
+		this.Error(w, NewHttpError(http.StatusForbidden, "Forbidden"))
+		return
+	}
+
 	// * 设置CORS响应头
     w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
@@ -312,14 +1374,67 @@ func (this *Apper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         return
     }
 	
+	// * 记录响应状态，中间件可通过GetResponser设置响应头
+	// * Record the response status, middleware can set headers through GetResponser
+	rw, r := newResponser(w, r)
+	w = rw
+	// * 恢復響應結束回調(After、OnBlock等)的panic
+	// * Recover panics from the finish callbacks such as After and OnBlock hooks
+	defer this.recovery(rw, r)
+	defer rw.finish()
+	// * 恢復處理函數和中間件的panic，在rw.finish之前執行，響應結束的回調可讀到500
+	// * Recover panics from handlers and middleware, runs before rw.finish so the finish callbacks see the 500
+	defer this.recovery(rw, r)
+
 	urlSpit := strings.Split(r.URL.String(), "?")
-	ipaddr := this.GetClientIP(r)
 	
-	// * 限流處理
-	// * Rate limiting processing
-	if this.rate.IsBlocked(ipaddr) {
-		this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " rate limit"
-		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	// * 限流處理，允許名單不限流，行爲監控和蜜罐的封禁同樣在此處理，開啓慢速響應時拖慢已封禁的客戶端
+	// * Rate limiting processing, allowlisted addresses are exempt, bans from behaviour monitoring and honeypots are enforced here too, banned clients are tarpitted when enabled
+	if access != AccessAllow && (this.rate.Started() || this.behave != nil || this.honey != nil) {
+		if reset := this.rate.BlockReset(ipaddr); reset > 0 {
+			if this.honey != nil && this.honey.Drip(w, r) {
+				this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " tarpit"
+				return
+			}
+			this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " rate limit"
+			SetRateHeaders(w.Header(), RateResult{Limit: this.rate.ErrMax, Reset: reset})
+			this.Error(w, this.TooManyRequests())
+			return
+		}
+	}
+	// * 蜜罐，任何方法都未注冊的蜜罐路徑立即封禁
+	// * Honeypot, honeypot paths not registered under any method are banned at once
+	if access != AccessAllow && this.honey != nil && this.honey.Match(urlSpit[0]) && !this.registered(urlSpit[0]) {
+		this.honey.Trap(ipaddr, urlSpit[0])
+		this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " honeypot"
+		if !this.honey.Drip(w, r) {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	// * 行爲監控，響應結束後記錄狀態
+	// * Behaviour monitoring records the status once the response is finished
+	if access != AccessAllow && this.behave != nil {
+		rw.After(func(status int) {
+			if reason := this.behave.RecordRequest(r, ipaddr, status); reason != "" {
+				this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " " + reason
+			}
+		})
+	}
+	if access != AccessAllow {
+		res := this.rate.Take(ipaddr)
+		SetRateHeaders(w.Header(), res)
+		if !res.Allowed {
+			this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " request limit"
+			this.Error(w, this.TooManyRequests())
+			return
+		}
+	}
+	// * 請求大小限制，在中間件讀取請求體之前
+	// * Request size limits, before any middleware reads the body
+	if err := this.sizer.Check(w, r, urlSpit[0]); err != nil {
+		this.msg <- ipaddr + " " + r.Method + " " + r.URL.Path + " " + err.Error()
+		this.Error(w, err)
 		return
 	}
 	// * 全局中間件處理
@@ -327,7 +1442,7 @@ func (this *Apper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, g := range this.gMiddleware {
 		err := g(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			this.Error(w, err)
 			return
 		}
 	}
@@ -338,7 +1453,7 @@ func (this *Apper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		for _, rone := range rs {
 			err := rone(r)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				this.Error(w, err)
 				return
 			}
 		}
@@ -348,12 +1463,32 @@ func (this *Apper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " 200 OK"
 		h(w, r)
 	} else {
-		this.rate.SetStatus(ipaddr) // * 限流處理
+		if access != AccessAllow {
+			this.rate.SetStatus(ipaddr) // * 限流處理
+		}
 		this.msg <- ipaddr + " " + r.Method + " " + r.URL.String() + " Not Found 404"
 		http.NotFound(w, r)
 	}
 }
 
+// listen 监听端口，并按配置包装监听器
+// listen listens on the port and wraps the listener according to configuration
+func (this *Apper) listen() net.Listener {
+	ln, err := net.Listen("tcp", ":"+this.port)
+	if err != nil {
+		panic(err)
+	}
+	if this.proxy != nil {
+		ln = this.proxy.Listener(ln)
+	}
+	// 在PROXY协议之后，按真实客户端地址计数
+	// After PROXY protocol so connections are counted by the real client address
+	if this.conner != nil {
+		ln = this.conner.Listener(ln)
+	}
+	return ln
+}
+
 // Run 启动HTTP服务器
 // Run starts the HTTP server
 func (this *Apper) Run() {
@@ -361,21 +1496,50 @@ func (this *Apper) Run() {
 	this.msg <- "apper HTTP is running in port:" + this.port
 	// this.msg <- "apper HTTP is running in port:" + this.port
 
+	err:=this.server().Serve(this.listen())
+	if err!=nil{
+		panic(err)
+	}
+}
+
+// server 创建Run使用的HTTP服务器，h2c开启时同时提供明文HTTP/2
+// server creates the HTTP server used by Run, also serving cleartext HTTP/2 when h2c is enabled
+func (this *Apper) server() *http.Server {
 	server := &http.Server{
 		Addr: ":" + this.port, 
 		Handler: this,
 		ReadHeaderTimeout: 60 * time.Second,
+		MaxHeaderBytes: this.sizer.MaxHeaderBytes,
+		HTTP2: this.http2,
 	}
-	err:=server.ListenAndServe()
-	if err!=nil{
-		panic(err)
+	if this.conner != nil {
+		server.ConnState = this.conner.ConnState
 	}
+	if this.h2c {
+		// * 明文HTTP/2，需客戶端直接使用HTTP/2(prior knowledge)
+		// * Cleartext HTTP/2, clients must use HTTP/2 with prior knowledge
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
 }
 
-// RunTLS 启动HTTPS服务器
-// RunTLS starts the HTTPS server
+// RunTLS 启动HTTPS服务器，certFile和keyFile為默認證書，可為空只使用[tls]中的證書
+// RunTLS starts the HTTPS server, certFile/keyFile is the default certificate and may be empty to use only the [tls] certificates
 func (this *Apper) RunTLS(certFile, keyFile string) {
+	if certFile != "" {
+		this.tls.Lock()
+		this.tls.CertFiles = append([]string{certFile}, this.tls.CertFiles...)
+		this.tls.KeyFiles = append([]string{keyFile}, this.tls.KeyFiles...)
+		this.tls.Unlock()
+	}
+	err := this.tls.Load()
+	if err != nil {
+		panic(err)
+	}
 	go this.Logger()
+	go this.tls.Watch()
 	this.msg <- "apper HTTPS is running in port:" + this.port
 	// this.msg <- "apper HTTPS is running in port:" + this.port
 
@@ -383,8 +1547,14 @@ func (this *Apper) RunTLS(certFile, keyFile string) {
 		Addr: ":" + this.port, 
 		Handler: this,
 		ReadHeaderTimeout: 30 * time.Second,
+		TLSConfig: this.tls.Config(),
+		MaxHeaderBytes: this.sizer.MaxHeaderBytes,
+		HTTP2: this.http2,
+	}
+	if this.conner != nil {
+		server.ConnState = this.conner.ConnState
 	}
-	err:=server.ListenAndServeTLS(certFile, keyFile)
+	err=server.ServeTLS(this.listen(), "", "")
 	if err!=nil{
 		panic(err)
 	}
@@ -1,9 +1,18 @@
 package goweber
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 	"errors"
 )
 
@@ -97,10 +106,11 @@ func TestApp(t *testing.T) {
 	
 	// * 測試暴力破解監控
 	bruter:=NewBruter()
+	defer bruter.Close()
 	app.Get("/brute", func(w http.ResponseWriter, r *http.Request) {
 	    ip:=bruter.GetClientIP(r)
-		if bruter.IsBlocked(ip) {
-			fmt.Fprintf(w, "暴力破解，IP被封禁%s", bruter.BlockIps[ip])
+		if until, ok := bruter.BlockedUntil(ip); ok {
+			fmt.Fprintf(w, "暴力破解，IP被封禁%s", until)
 			return
 		}
 		// 出現錯誤時，將IP加入監控列表
@@ -114,3 +124,183 @@ func TestApp(t *testing.T) {
 	app.Print("rate")
 	app.Run()
 }
+
+func TestPanicRecovery(t *testing.T) {
+	app := New()
+	logs := make(chan string, 10)
+	go func() {
+		for msg := range app.msg {
+			if strings.Contains(msg, " panic: ") {
+				logs <- msg
+			}
+		}
+	}()
+	defer app.Close()
+	var reported any
+	app.OnPanic = func(r *http.Request, err any, stack []byte) {
+		reported = err
+	}
+	app.Get("/boom", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	app.Get("/late", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late")
+	})
+
+	w := serve(app, "GET", "/boom", nil)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), `"code":500`) {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if reported != "boom" {
+		t.Fatalf("OnPanic got %v", reported)
+	}
+	if msg := <-logs; !strings.Contains(msg, "GET /boom panic: boom") || !strings.Contains(msg, "goroutine") {
+		t.Fatalf("log = %q", msg)
+	}
+	// 已寫入響應時保留原狀態碼
+	if w := serve(app, "GET", "/late", nil); w.Code != http.StatusAccepted {
+		t.Fatalf("got %d", w.Code)
+	}
+	<-logs
+
+	// 響應結束回調的panic同樣恢復，其他回調仍執行
+	counted := 0
+	app.Get("/after", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }, func(r *http.Request) error {
+		GetResponser(r).After(func(status int) { counted = status })
+		GetResponser(r).After(func(status int) { panic("after") }) // 後注冊的先執行
+		return nil
+	})
+	if w := serve(app, "GET", "/after", nil); w.Code != http.StatusOK || counted != http.StatusOK {
+		t.Fatalf("got %d counted %d", w.Code, counted)
+	}
+	if msg := <-logs; !strings.Contains(msg, "GET /after panic: after") {
+		t.Fatalf("log = %q", msg)
+	}
+
+	// 中間件panic同樣恢復，中止響應的panic交給net/http
+	app.Use(func(r *http.Request) error {
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		panic(errors.New("middleware"))
+	})
+	if w := serve(app, "GET", "/boom", nil); w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d", w.Code)
+	}
+	<-logs
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Fatalf("recover = %v", err)
+		}
+	}()
+	serve(app, "GET", "/abort", nil)
+}
+
+func TestLoggerRotate(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "access.log")
+	logfile, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &Apper{msg: make(chan string), logfile: logfile, logmax: 1}
+	app.log = log.New(logfile, "", log.LstdFlags)
+	done := make(chan struct{})
+	go func() {
+		app.Logger()
+		close(done)
+	}()
+	app.msg <- "first"
+	app.msg <- "second"
+	app.msg <- "third" // Logger收到下一條時上一條已處理
+	files, _ := filepath.Glob(name + "*")
+	if len(files) < 2 {
+		t.Fatalf("files = %v", files)
+	}
+	// 日誌目錄被刪除，無法重新打開時改為輸出到標準輸出，不再panic
+	os.RemoveAll(dir)
+	app.msg <- "fourth"
+	close(app.msg)
+	<-done
+	if app.log != nil {
+		t.Fatal("應改為輸出到標準輸出")
+	}
+}
+
+// 只使用明文HTTP/2(prior knowledge)的客戶端
+func h2cClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func TestHTTP2(t *testing.T) {
+	app := newTestApp(t)
+	app.Config.params["http2"] = map[string]string{"h2c": "1", "maxstreams": "7"}
+	app.SetHTTP2()
+	app.Get("/proto", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	ts := httptest.NewUnstartedServer(app)
+	ts.Config = app.server()
+	ts.Start()
+	defer ts.Close()
+
+	// 開啓h2c時以HTTP/2響應，HTTP/1.1仍可用
+	resp, err := h2cClient().Get(ts.URL + "/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("proto %q", body)
+	}
+	resp, err = http.Get(ts.URL + "/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/1.1" {
+		t.Fatalf("proto %q", body)
+	}
+
+	// 服務器的SETTINGS幀帶有配置的最大并發流
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00"))
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header); err != nil || header[3] != 0x4 {
+		t.Fatalf("settings frame %x %v", header, err)
+	}
+	payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	streams := -1
+	for i := 0; i+6 <= len(payload); i += 6 {
+		if binary.BigEndian.Uint16(payload[i:]) == 0x3 { // SETTINGS_MAX_CONCURRENT_STREAMS
+			streams = int(binary.BigEndian.Uint32(payload[i+2:]))
+		}
+	}
+	if streams != 7 {
+		t.Fatalf("max concurrent streams %d", streams)
+	}
+
+	// 未開啓h2c時拒絕明文HTTP/2
+	app.h2c = false
+	off := httptest.NewUnstartedServer(app)
+	off.Config = app.server()
+	off.Start()
+	defer off.Close()
+	if resp, err := h2cClient().Get(off.URL + "/proto"); err == nil {
+		resp.Body.Close()
+		t.Fatal("h2c served while disabled")
+	}
+}
@@ -0,0 +1,107 @@
+// * 封禁事件和安全審計日志
+// * Rater、Bruter封禁或解封時調用OnBlock/OnUnblock，Auditer把事件按JSON行寫入獨立的審計日志
+// * 解封包括到期(後台清理時發現)和手動解封
+package goweber
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// 封禁事件類型
+const (
+	EventBlock   = "block"
+	EventUnblock = "unblock"
+)
+
+// BanEvent 封禁事件
+// BanEvent describes a block or unblock
+type BanEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`           // block,unblock
+	Source string    `json:"source"`          // rate,brute,admin
+	Key    string    `json:"key"`             // IP或聚合前綴
+	Reason string    `json:"reason"`          // 原因
+	Count  int64     `json:"count,omitempty"` // 觸發封禁時的錯誤數
+	Limit  int       `json:"limit,omitempty"` // 封禁閾值
+	Until  time.Time `json:"until,omitzero"`  // 解封時間，零值為永久
+}
+
+// 封禁回調，嵌入Rater和Bruter
+type banHooks struct {
+	OnBlock   func(ev BanEvent) // 封禁後調用
+	OnUnblock func(ev BanEvent) // 到期或手動解封後調用
+	active    *shardMap[time.Time]
+}
+
+func newBanHooks() banHooks {
+	return banHooks{active: newShardMap[time.Time]()}
+}
+
+// 記錄封禁并調用OnBlock
+func (this *banHooks) blocked(ev BanEvent) {
+	ev.Time, ev.Event = time.Now(), EventBlock
+	this.active.Set(ev.Key, ev.Until)
+	if this.OnBlock != nil {
+		this.OnBlock(ev)
+	}
+}
+
+// 調用OnUnblock
+func (this *banHooks) unblocked(source, key, reason string, until time.Time) {
+	this.active.Delete(key)
+	if this.OnUnblock != nil {
+		this.OnUnblock(BanEvent{Time: time.Now(), Event: EventUnblock, Source: source, Key: key, Reason: reason, Until: until})
+	}
+}
+
+// 已到期的封禁調用OnUnblock
+func (this *banHooks) expireBlocks(source string, now time.Time) {
+	var expired []BanEvent
+	this.active.DeleteIf(func(key string, until time.Time) bool {
+		if now.Before(until) {
+			return false
+		}
+		expired = append(expired, BanEvent{Key: key, Until: until})
+		return true
+	})
+	for _, ev := range expired {
+		this.unblocked(source, ev.Key, "expired", ev.Until)
+	}
+}
+
+// Auditer 安全審計日志，每行一個JSON事件
+// Auditer writes ban events to a security audit log as JSON lines
+type Auditer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewAuditer(file string) (*Auditer, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditer{file: f}, nil
+}
+
+// Write 寫入一個事件
+// Write appends one event
+func (this *Auditer) Write(ev BanEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err = this.file.Write(append(line, '\n'))
+	return err
+}
+
+func (this *Auditer) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.file.Close()
+}
@@ -0,0 +1,162 @@
+package goweber
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBanHooks(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 2
+	var mu sync.Mutex
+	var events []BanEvent
+	record := func(ev BanEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	bruter.OnBlock = record
+	bruter.OnUnblock = record
+	bruter.SetStatus("192.0.2.1")
+	bruter.SetStatus("192.0.2.1")
+	if len(events) != 1 {
+		t.Fatalf("events %v", events)
+	}
+	ev := events[0]
+	if ev.Event != EventBlock || ev.Source != "brute" || ev.Key != "192.0.2.1" || ev.Count != 2 || ev.Limit != 2 || time.Until(ev.Until) < 23*time.Hour {
+		t.Fatalf("block event %+v", ev)
+	}
+	// 到期後清理時發出解封事件
+	bruter.expireBlocks("brute", ev.Until)
+	if len(events) != 2 || events[1].Event != EventUnblock || events[1].Reason != "expired" {
+		t.Fatalf("expire events %v", events)
+	}
+	bruter.SetStatus("192.0.2.2")
+	bruter.SetStatus("192.0.2.2")
+	if err := bruter.Unblock("192.0.2.2", "admin"); err != nil || bruter.IsBlocked("192.0.2.2") {
+		t.Fatal("unblock failed")
+	}
+	if last := events[len(events)-1]; last.Event != EventUnblock || last.Reason != "admin" {
+		t.Fatalf("unblock event %+v", last)
+	}
+	bruter.expireBlocks("brute", time.Now().Add(48*time.Hour))
+	if len(events) != 4 {
+		t.Fatalf("manually unblocked key expired again: %v", events)
+	}
+}
+
+func TestAuditer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "security.log")
+	a, err := NewAuditer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Write(BanEvent{Event: EventBlock, Source: "rate", Key: "192.0.2.1", Reason: "test", Until: time.Now()})
+	a.Write(BanEvent{Event: EventUnblock, Source: "admin", Key: "192.0.2.0/24"})
+	a.Close()
+	data, _ := os.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines %q", data)
+	}
+	var ev BanEvent
+	if err := json.Unmarshal([]byte(lines[1]), &ev); err != nil || ev.Key != "192.0.2.0/24" {
+		t.Fatalf("line %s: %v", lines[1], err)
+	}
+	if strings.Contains(lines[1], "until") {
+		t.Fatalf("zero until written: %s", lines[1])
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var calls atomic.Int32
+	var got BanEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t" {
+			t.Error("missing header")
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	hook := NewWebhooker(srv.URL)
+	hook.Backoff = time.Millisecond
+	hook.Header = map[string]string{"Authorization": "Bearer t"}
+	hook.OnError = func(ev BanEvent, err error) { t.Error(err) }
+	hook.Start()
+	hook.Notify(BanEvent{Event: EventBlock, Key: "192.0.2.1"})
+	hook.Close()
+	if calls.Load() != 3 || got.Key != "192.0.2.1" {
+		t.Fatalf("calls %d event %+v", calls.Load(), got)
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	hook := NewWebhooker(srv.URL)
+	hook.Backoff = time.Millisecond
+	hook.Retries = 1
+	failed := make(chan error, 1)
+	hook.OnError = func(ev BanEvent, err error) { failed <- err }
+	hook.Start()
+	defer hook.Close()
+	hook.Notify(BanEvent{Key: "192.0.2.1"})
+	select {
+	case err := <-failed:
+		if !strings.Contains(err.Error(), "500") {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported")
+	}
+}
+
+func TestWebhookCloseDrain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	hook := NewWebhooker(srv.URL)
+	hook.Backoff = time.Hour
+	hook.Drain = 50 * time.Millisecond
+	var failed atomic.Int32
+	hook.OnError = func(ev BanEvent, err error) { failed.Add(1) }
+	hook.Start()
+	for i := 0; i < 100; i++ {
+		hook.Notify(BanEvent{Key: "192.0.2.1"})
+	}
+	// 通知地址不可用時，關閉不等待退避，最多等待Drain
+	start := time.Now()
+	hook.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("close took %s", d)
+	}
+	if failed.Load() != 100 {
+		t.Fatalf("failed = %d", failed.Load())
+	}
+}
+
+func TestAuditAfterClose(t *testing.T) {
+	app := New()
+	// Logger未啓動時不阻塞，Close後不panic
+	for i := 0; i < 2000; i++ {
+		app.Audit(BanEvent{Source: "rate", Event: EventBlock, Key: "192.0.2.1"})
+	}
+	app.Close()
+	app.Audit(BanEvent{Source: "rate", Event: EventUnblock, Key: "192.0.2.1"})
+}
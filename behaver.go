@@ -0,0 +1,187 @@
+// * 行爲監控
+// * ServeHTTP記錄每個請求的響應狀態和時間，發現危險行爲時寫入Rater的封禁列表
+// * 目錄掃描：Window秒内404數量達到NotFound，例如/project/user,/project/admin
+// * 機器人：最近Samples次請求的間隔都不小於MinInterval，且相鄰間隔相差不超過Jitter，即等間隔請求
+// * 瀏覽器加載頁面資源時間隔很短，MinInterval用於排除這種情況
+// * 健康檢查、監控服務和輪詢的前端也是等間隔請求，機器人檢查默認關閉，可按Paths、Agents排除
+// * 監控數據保存在進程内，後台協程定時清理過期數據，Close後停止
+package goweber
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behaver 行爲監控，參數需在使用前設置
+// Behaver detects directory scans and bot-like request timing and bans through the Rater
+type Behaver struct {
+	Window      int           // 監控周期秒
+	NotFound    int           // 周期内404數量，0為不檢查
+	Samples     int           // 判斷機器人使用的最近請求數，0為不檢查，默認不檢查
+	MinInterval time.Duration // 機器人請求的最小間隔
+	Jitter      time.Duration // 相鄰間隔相差不超過該值視爲等間隔
+	Paths       []string      // 不檢查機器人的路徑前綴，如健康檢查/healthz
+	Agents      []string      // 不檢查機器人的User-Agent子串，如監控服務
+	Block       int           // 封禁秒
+	MaxIp       int           // 監控IP數量
+	Rater       *Rater        // 封禁寫入Rater的封禁列表，使用其地址聚合
+	data        *shardMap[*behaveIP]
+	trim        throttle // 超過MaxIp時的清理頻率
+	stop        chan struct{}
+	closeOnce   sync.Once
+}
+
+// 一個IP在當前周期内的行爲
+type behaveIP struct {
+	start    time.Time   // 周期開始時間
+	notFound int         // 404數量
+	times    []time.Time // 最近Samples次請求時間
+}
+
+// 實例化，啓動後台清理協程
+func NewBehaver(rater *Rater) *Behaver {
+	behaver := &Behaver{
+		Window:      300,
+		NotFound:    50,
+		Samples:     0,
+		MinInterval: 500 * time.Millisecond,
+		Jitter:      100 * time.Millisecond,
+		Block:       3600,
+		MaxIp:       10000,
+		Rater:       rater,
+		data:        newShardMap[*behaveIP](),
+		stop:        make(chan struct{}),
+	}
+	go behaver.expire(time.Minute)
+	return behaver
+}
+
+// * 記錄一次請求，發現危險行爲時封禁並返回原因
+func (this *Behaver) Record(ip string, status int) string {
+	return this.record(ip, status, true)
+}
+
+// * 記錄一次請求，路徑或User-Agent在排除列表中時只檢查目錄掃描
+func (this *Behaver) RecordRequest(r *http.Request, ip string, status int) string {
+	return this.record(ip, status, !this.Exempt(r))
+}
+
+// * 請求是否不檢查機器人
+func (this *Behaver) Exempt(r *http.Request) bool {
+	for _, path := range this.Paths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	agent := r.UserAgent()
+	for _, s := range this.Agents {
+		if s != "" && strings.Contains(agent, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// timing為false時不記錄請求時間
+func (this *Behaver) record(ip string, status int, timing bool) string {
+	now := time.Now()
+	window := time.Duration(this.Window) * time.Second
+	// 超過監控上綫，限頻清理周期已結束的IP，仍超過時刪除任意IP
+	if this.data.Len() >= this.MaxIp {
+		if this.trim.allow(now, time.Second) {
+			this.clear(now)
+		}
+		this.data.Trim(this.MaxIp-1, nil) // 為新IP留出位置
+	}
+	key := this.Rater.Prefixer.Key(ip)
+	var reason string
+	var count int64
+	var limit int
+	this.data.Do(key, func(m map[string]*behaveIP) {
+		b, ok := m[key]
+		if !ok || now.Sub(b.start) >= window {
+			b = &behaveIP{start: now}
+			m[key] = b
+		}
+		if status == 404 {
+			b.notFound++
+		}
+		if this.Samples > 1 && timing {
+			b.times = append(b.times, now)
+			if len(b.times) > this.Samples {
+				b.times = b.times[len(b.times)-this.Samples:]
+			}
+		}
+		switch {
+		case this.NotFound > 0 && b.notFound >= this.NotFound:
+			reason, count, limit = "directory scan", int64(b.notFound), this.NotFound
+		case this.Samples > 1 && len(b.times) == this.Samples && this.robotic(b.times):
+			reason, count, limit = "robotic timing", int64(this.Samples), this.Samples
+		default:
+			return
+		}
+		delete(m, key)
+	})
+	if reason == "" {
+		return ""
+	}
+	until := now.Add(time.Duration(this.Block) * time.Second)
+	this.Rater.block(ip, BanEvent{Source: "behave", Reason: reason, Count: count, Limit: limit, Until: until})
+	return reason
+}
+
+// 請求是否等間隔
+func (this *Behaver) robotic(times []time.Time) bool {
+	prev := time.Duration(-1)
+	for i := 1; i < len(times); i++ {
+		interval := times[i].Sub(times[i-1])
+		if interval < this.MinInterval {
+			return false
+		}
+		if prev >= 0 && (interval-prev > this.Jitter || prev-interval > this.Jitter) {
+			return false
+		}
+		prev = interval
+	}
+	return true
+}
+
+// * 監控中的IP數量
+func (this *Behaver) Len() int {
+	return this.data.Len()
+}
+
+// 清除周期已結束的IP
+func (this *Behaver) clear(now time.Time) {
+	window := time.Duration(this.Window) * time.Second
+	this.data.DeleteIf(func(key string, b *behaveIP) bool {
+		return now.Sub(b.start) >= window
+	})
+}
+
+// * 後台定時清理過期數據
+func (this *Behaver) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case now := <-ticker.C:
+			this.clear(now)
+		}
+	}
+}
+
+// * 停止後台清理
+func (this *Behaver) Close() {
+	this.closeOnce.Do(func() { close(this.stop) })
+}
+
+func (this *Behaver) String() string {
+	return fmt.Sprintf("&{Window:%d NotFound:%d Samples:%d MinInterval:%s Jitter:%s Paths:%v Agents:%v Block:%d MaxIp:%d}",
+		this.Window, this.NotFound, this.Samples, this.MinInterval, this.Jitter, this.Paths, this.Agents, this.Block, this.MaxIp)
+}
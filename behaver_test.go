@@ -0,0 +1,136 @@
+package goweber
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBehaverScan(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	behaver := NewBehaver(rater)
+	defer behaver.Close()
+	behaver.NotFound = 3
+	behaver.Samples = 0
+	var events []BanEvent
+	rater.OnBlock = func(ev BanEvent) { events = append(events, ev) }
+	for i := 0; i < 2; i++ {
+		if reason := behaver.Record("192.0.2.1", 404); reason != "" {
+			t.Fatalf("detected after %d: %s", i+1, reason)
+		}
+		behaver.Record("192.0.2.1", 200)
+	}
+	if reason := behaver.Record("192.0.2.1", 404); reason != "directory scan" {
+		t.Fatalf("reason %q", reason)
+	}
+	if rater.BlockReset("192.0.2.1") < 59*time.Minute || behaver.Len() != 0 {
+		t.Fatal("scan not blocked")
+	}
+	if len(events) != 1 || events[0].Source != "behave" || events[0].Count != 3 {
+		t.Fatalf("events %+v", events)
+	}
+}
+
+func TestBehaverRobot(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	behaver := NewBehaver(rater)
+	defer behaver.Close()
+	behaver.Samples = 4
+	start := time.Now()
+	at := func(ms ...int) []time.Time {
+		var res []time.Time
+		for _, m := range ms {
+			res = append(res, start.Add(time.Duration(m)*time.Millisecond))
+		}
+		return res
+	}
+	for _, c := range []struct {
+		ms    []int
+		robot bool
+	}{
+		{[]int{0, 1000, 2000, 3050}, true},  // 等間隔
+		{[]int{0, 1000, 2000, 3500}, false}, // 間隔變化
+		{[]int{0, 10, 20, 30}, false},       // 頁面資源加載
+	} {
+		if behaver.robotic(at(c.ms...)) != c.robot {
+			t.Fatalf("%v robot %v", c.ms, !c.robot)
+		}
+	}
+	// 記錄時只保留最近Samples次
+	behaver.MinInterval = 0
+	behaver.Jitter = time.Second
+	for i := 0; i < 3; i++ {
+		behaver.Record("192.0.2.2", 200)
+	}
+	if reason := behaver.Record("192.0.2.2", 200); reason != "robotic timing" || behaver.Rater.BlockReset("192.0.2.2") == 0 {
+		t.Fatalf("reason %q", reason)
+	}
+}
+
+func TestBehaveServe(t *testing.T) {
+	app := newTestApp(t)
+	app.rate.SetStart(0) // 404封禁關閉時行爲監控的封禁仍然生效
+	app.behave = NewBehaver(app.rate)
+	defer app.behave.Close()
+	app.behave.NotFound = 3
+	app.Get("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 3; i++ {
+		serve(app, "GET", "/scan", nil)
+	}
+	if w := serve(app, "GET", "/ok", nil); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("scanner served: %d", w.Code)
+	}
+}
+
+func TestBehaveHealthCheck(t *testing.T) {
+	app := newTestApp(t)
+	app.behave = NewBehaver(app.rate)
+	defer app.behave.Close()
+	app.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	app.Get("/status", func(w http.ResponseWriter, r *http.Request) {})
+	// 默認不檢查等間隔請求
+	if app.behave.Samples != 0 {
+		t.Fatalf("samples = %d", app.behave.Samples)
+	}
+	app.behave.Samples = 4
+	app.behave.MinInterval = 0
+	app.behave.Jitter = time.Second
+	app.behave.Paths = []string{"/healthz"}
+	app.behave.Agents = []string{"UptimeRobot"}
+	// 負載均衡的健康檢查和監控服務按路徑、User-Agent排除，不被封禁
+	for i := 0; i < 10; i++ {
+		if w := serve(app, "GET", "/healthz", nil); w.Code != http.StatusOK {
+			t.Fatalf("health check %d: %d", i, w.Code)
+		}
+		if w := serve(app, "GET", "/status", http.Header{"User-Agent": {"Mozilla/5.0+(compatible; UptimeRobot/2.0)"}}); w.Code != http.StatusOK {
+			t.Fatalf("monitor %d: %d", i, w.Code)
+		}
+	}
+	if app.rate.BlockReset("192.0.2.1") != 0 {
+		t.Fatal("health check blocked")
+	}
+	// 其他等間隔請求仍被封禁
+	for i := 0; i < 4; i++ {
+		serve(app, "GET", "/status", nil)
+	}
+	if w := serve(app, "GET", "/status", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("robot served: %d", w.Code)
+	}
+}
+
+func TestBehaverMaxIp(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	behaver := NewBehaver(rater)
+	defer behaver.Close()
+	behaver.MaxIp = 100
+	// 周期内的IP不過期，地址輪換時仍不超過MaxIp
+	for _, ip := range benchIps(1000) {
+		behaver.Record(ip, 404)
+		if behaver.Len() > behaver.MaxIp {
+			t.Fatalf("%d ips", behaver.Len())
+		}
+	}
+}
@@ -1,120 +1,453 @@
 // * 暴力破解監控
 // * 舉例：同一個對/login，在一段時間内報錯多次，判定暴力破解，禁用IP 24小時
 // * 設定：1分鐘內，10次錯誤，則禁用IP 24小時
+// * 封禁時長按Lockouts遞增：Forget時間内第1次封禁1分鐘，第2次5分鐘……超出列表時使用最後一個
+// * 封禁前的每次失敗可用Delay延遲響應，延遲隨錯誤數翻倍；登錄成功調用Success清除計數
+// * 同時按IP、賬號、IP+路由計數，閾值各自獨立：分散到多個IP的撞庫按賬號發現，同一NAT出口的辦公室按路由隔離
+// * key：IP直接使用，賬號用BruteUser(name)，IP+路由用BruteRoute(ip, path)，或用Keys(r, user)一次生成
+// * 中間件：app.Post("/login", login, bruter.Protect())，已封禁返回429，響應為401、403時記錄失敗
+// * 處理函數可用BruteFail、BruteOK明確標記結果，用bruter.Account(r, user)同時按賬號計數
+// * BruteOK只清除登錄成功賬號的計數，IP和路由的計數不清除，到期自動恢復，避免攻擊者用自己的賬號登錄重置計數
+// * 監控和封禁列表保存在Store中，可與Apper共用：bruter.Store = app.GetStore()，後台協程定時清理過期數據，Close後停止
 package goweber
 
 import (
-	"time"
-	"sync"
+	"errors"
+	"fmt"
 	"net/http"
-	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
+// ErrNoResponser Protect不經Apper使用時無法取得響應狀態，只檢查封禁，不記錄失敗
+// ErrNoResponser means Protect runs outside Apper and cannot see the response status, so it only enforces blocks
+var ErrNoResponser = errors.New("bruter: 無法取得響應狀態，Protect只檢查封禁")
+
+// 參數需在使用前設置
 type Bruter struct {
 	// 1分鐘內，10次錯誤，則禁用IP 24小時
-	MaxIp int // 監控IP數量
-	MaxErr int // 監控錯誤數量
-	MaxTime int // 監控時間秒
-	ErrIps   map[string]*BruterIP
-	BlockIps map[string]time.Time
-	sync.RWMutex
+	MaxIp     int             // 監控IP數量
+	MaxErr    int             // 監控錯誤數量
+	UserErr   int             // 每個賬號的錯誤數量，0為不按賬號計數，默認不計數：任何人都可用錯誤密碼鎖定他人賬號
+	RouteErr  int             // 每個IP每個路由的錯誤數量，0為不按路由計數
+	MaxTime   int             // 監控時間秒
+	Lockouts  []time.Duration // 第n次封禁的時長，超出時使用最後一個
+	Forget    time.Duration   // 重複封禁次數的保留時間，從首次封禁起計
+	DelayBase time.Duration   // 第1次失敗後的延遲，之後每次翻倍，0為不延遲
+	DelayMax  time.Duration   // 最大延遲
+	Iper      *Iper           // IP解析器
+	Accesser  *Accesser       // 訪問控制，允許名單不封禁，可與Apper共用：bruter.Accesser = app.Accesser
+	Store     Store           // 監控和封禁列表存儲
+	Prefixer  *Prefixer       // 地址聚合，nil為按單個地址，可與Apper共用：bruter.Prefixer = app.Prefixer
+	OnError   func(err error) // 存儲出錯時調用，出錯時不封禁；Protect無法跟蹤響應狀態時以ErrNoResponser調用一次
+	Body      string          // Protect的429響應內容，JSON格式，為空時為純文本，與Apper共用[rate] body
+	stop      chan struct{}
+	closeOnce sync.Once
+	noRw      sync.Once
+	trim      throttle // Store中計數超過MaxIp時的清理頻率
+	banHooks           // OnBlock,OnUnblock
 }
 
 type BruterIP struct {
-	IP string
-	Err int
+	IP       string
+	Err      int
 	LastTime time.Time
 }
 
+// 實例化，啓動後台清理協程
 func NewBruter() *Bruter {
-    return &Bruter{
-		MaxIp: 10000,
-		MaxErr: 10,
-		MaxTime: 60,
-		ErrIps: make(map[string]*BruterIP),
-		BlockIps:make(map[string]time.Time),
-    }
+	bruter := &Bruter{
+		MaxIp:    10000,
+		MaxErr:   10,
+		UserErr:  0,
+		RouteErr: 5,
+		MaxTime:  60,
+		Lockouts: []time.Duration{24 * time.Hour},
+		Forget:   24 * time.Hour,
+		DelayMax: 5 * time.Second,
+		Iper:     NewIper(),
+		Store:    NewMemoryStore(),
+		banHooks: newBanHooks(),
+		stop:     make(chan struct{}),
+	}
+	go bruter.expire(time.Minute)
+	return bruter
 }
 
-// 獲得IP
+// 獲得IP，使用Iper解析，可與Apper共用：bruter.Iper = app.Iper
 func (this *Bruter) GetClientIP(r *http.Request) string {
-	// 优先从X-Forwarded-For头获取IP
-	// Prioritize getting IP from X-Forwarded-For header
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		// 如果X-Forwarded-For为空，则尝试从X-Real-IP头获取
-		// If X-Forwarded-For is empty, try to get from X-Real-IP header
-		ip = r.Header.Get("X-Real-IP")
-	}
-	// 如果两个头都没有值，则使用RemoteAddr
-	// If both headers have no value, use RemoteAddr
-	if ip == "" {
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return this.Iper.GetClientIP(r)
+}
+
+// 賬號和路由key的前綴
+const (
+	bruteUser  = "user:"
+	bruteRoute = "route:"
+)
+
+// BruteUser 賬號key
+func BruteUser(user string) string {
+	return bruteUser + user
+}
+
+// BruteRoute IP+路由key
+func BruteRoute(ip, route string) string {
+	return bruteRoute + ip + " " + route
+}
+
+// * 請求的IP、IP+路由key，user不為空時加上賬號key
+func (this *Bruter) Keys(r *http.Request, user string) []string {
+	ip := this.GetClientIP(r)
+	keys := []string{ip, BruteRoute(ip, r.URL.Path)}
+	if user != "" {
+		keys = append(keys, BruteUser(user))
+	}
+	return keys
+}
+
+// 路由key中的IP或前綴，其他key原樣返回
+func bruteAddr(key string) string {
+	if rest, ok := strings.CutPrefix(key, bruteRoute); ok {
+		ip, _, _ := strings.Cut(rest, " ")
+		return ip
+	}
+	return key
+}
+
+// 解析key，返回存儲key、所屬IP(賬號為空)、閾值和封禁原因
+func (this *Bruter) parseKey(key string) (string, string, int, string) {
+	if _, ok := strings.CutPrefix(key, bruteUser); ok {
+		return key, "", this.UserErr, "brute force account"
+	}
+	if rest, ok := strings.CutPrefix(key, bruteRoute); ok {
+		ip, route, _ := strings.Cut(rest, " ")
+		return BruteRoute(this.Prefixer.Key(ip), route), ip, this.RouteErr, "brute force route"
+	}
+	return this.Prefixer.Key(key), key, this.MaxErr, "brute force"
+}
+
+// * 檢查任一key是否被禁用，key為IP、BruteUser或BruteRoute
+func (this *Bruter) IsBlocked(keys ...string) bool {
+	_, ok := this.BlockedUntil(keys...)
+	return ok
+}
+
+// * 解封時間，取所有key中最晚的，未封禁時返回false
+func (this *Bruter) BlockedUntil(keys ...string) (time.Time, bool) {
+	var res time.Time
+	blocked := false
+	for _, key := range keys {
+		storeKey, ip, _, _ := this.parseKey(key)
+		if ip != "" && this.Accesser.Check(ip) == AccessAllow {
+			continue
+		}
+		var until time.Time
+		var ok bool
+		var err error
+		if ip == key {
+			until, ok, err = this.Prefixer.blockedUntil(this.Store, storeBruteBlock, ip)
+		} else {
+			var e StoreEntry
+			e, ok, err = this.Store.Get(storeBruteBlock + storeKey)
+			until = e.Expire
+		}
 		if err != nil {
-			return "unknown" // 格式化错误，返回未知IP
-			// Formatting error, return unknown IP
+			this.fail(err)
+			continue
+		}
+		if ok && (!blocked || until.After(res)) {
+			res, blocked = until, true
 		}
-		return ip
 	}
+	return res, blocked
+}
 
-	return ip
+// * 記錄一次失敗，每個key按各自的閾值計數
+func (this *Bruter) SetStatus(keys ...string) {
+	trimStore(this.Store, this.MaxIp, storeBruteErr, &this.trim)
+	for _, key := range keys {
+		this.setStatus(key)
+	}
+}
+
+func (this *Bruter) setStatus(key string) {
+	storeKey, ip, max, reason := this.parseKey(key)
+	if max <= 0 || ip != "" && this.Accesser.Check(ip) == AccessAllow {
+		return
+	}
+	count, err := this.Store.Incr(storeBruteErr+storeKey, time.Duration(this.MaxTime)*time.Second)
+	if err != nil {
+		this.fail(err)
+		return
+	}
+	if count < int64(max) {
+		return
+	}
+	until := time.Now().Add(this.lockout(storeKey))
+	var escalated string
+	var n int64
+	if ip == key {
+		escalated, n, err = this.Prefixer.block(this.Store, storeBruteBlock, storeBruteEsc, ip, until)
+	} else {
+		err = this.Store.SetBlock(storeBruteBlock+storeKey, until)
+	}
+	if err != nil {
+		this.fail(err)
+		return
+	}
+	this.blocked(BanEvent{Source: "brute", Key: storeKey, Reason: reason, Count: count, Limit: max, Until: until})
+	if escalated != "" {
+		this.blocked(BanEvent{Source: "brute", Key: escalated, Reason: "escalate", Count: n, Limit: this.Prefixer.Escalate, Until: until})
+	}
+	if err := this.Store.Delete(storeBruteErr + storeKey); err != nil {
+		this.fail(err)
+	}
 }
 
-// * 檢查IP是否被禁用
-func (this *Bruter) IsBlocked(ip string) bool {
-    this.RLock()
-	defer this.RUnlock()
-	if len(this.BlockIps) > this.MaxIp {
-		this.Clear()
+// 第n次封禁的時長，存儲出錯時按第1次
+func (this *Bruter) lockout(storeKey string) time.Duration {
+	if len(this.Lockouts) == 0 {
+		return 24 * time.Hour
 	}
-	if _, ok := this.BlockIps[ip]; ok {
-		// 是否鎖定超24小時
-		if this.BlockIps[ip].After(time.Now()) {
-			return true
+	level, err := this.Store.Incr(storeBruteLevel+storeKey, this.Forget)
+	if err != nil {
+		this.fail(err)
+		level = 1
+	}
+	return this.Lockouts[min(int(level), len(this.Lockouts))-1]
+}
+
+// * 登錄成功，清除各key的錯誤計數，重複封禁次數保留到Forget過期
+func (this *Bruter) Success(keys ...string) {
+	for _, key := range keys {
+		storeKey, _, _, _ := this.parseKey(key)
+		if err := this.Store.Delete(storeBruteErr + storeKey); err != nil {
+			this.fail(err)
 		}
-		delete(this.BlockIps, ip)
-		return false
-	}
-	return false
-}
-// * 改變IP狀態
-func (this *Bruter) SetStatus(ip string) {
-    this.Lock()
-	defer this.Unlock()
-	if len(this.ErrIps) > this.MaxIp {
-		this.Clear()
-	}
-	if _, ok := this.ErrIps[ip]; !ok {
-		this.ErrIps[ip] = &BruterIP{
-			IP: ip,
-			Err: 1,
-			LastTime: time.Now(),
+	}
+}
+
+// * 下一次響應前的延遲，按各key中最多的錯誤數計算，DelayBase為0時不延遲
+func (this *Bruter) Delay(keys ...string) time.Duration {
+	if this.DelayBase <= 0 {
+		return 0
+	}
+	var count int64
+	for _, key := range keys {
+		storeKey, _, _, _ := this.parseKey(key)
+		e, ok, err := this.Store.Get(storeBruteErr + storeKey)
+		if err != nil {
+			this.fail(err)
+			continue
 		}
-	} else {
-		this.ErrIps[ip].Err++
+		if ok && e.Value > count {
+			count = e.Value
+		}
+	}
+	if count == 0 {
+		return 0
 	}
-	if time.Since(this.ErrIps[ip].LastTime) > time.Duration(this.MaxTime)*time.Second {
-		this.ErrIps[ip].Err = 1
-		this.ErrIps[ip].LastTime = time.Now()
+	delay := this.DelayBase
+	for i := int64(1); i < count && delay < this.DelayMax; i++ {
+		delay *= 2
 	}
-	if this.ErrIps[ip].Err >= this.MaxErr {
-		this.BlockIps[ip] = time.Now().Add(24 * time.Hour)
-		delete(this.ErrIps, ip)
+	if this.DelayMax > 0 && delay > this.DelayMax {
+		delay = this.DelayMax
 	}
+	return delay
 }
 
-// * 清除過期IP
-func (this *Bruter) Clear() {
-    this.Lock()
-	defer this.Unlock()
-	for ip, _ := range this.ErrIps {
-		if time.Since(this.ErrIps[ip].LastTime) > time.Duration(this.MaxTime)*time.Second {
-			delete(this.ErrIps, ip)
+// * 手動解封，key為Blocked中的key，調用OnUnblock
+func (this *Bruter) Unblock(key, reason string) error {
+	if err := this.Store.Delete(storeBruteBlock + key); err != nil {
+		return err
+	}
+	this.unblocked("brute", key, reason, time.Time{})
+	return nil
+}
+
+// * 封禁列表快照，key對應解封時間
+func (this *Bruter) Blocked() map[string]time.Time {
+	res := make(map[string]time.Time)
+	entries, err := this.Store.List(storeBruteBlock)
+	if err != nil {
+		this.fail(err)
+	}
+	for _, e := range entries {
+		res[strings.TrimPrefix(e.Key, storeBruteBlock)] = e.Expire
+	}
+	return res
+}
+
+// * 監控列表快照
+func (this *Bruter) Monitored() map[string]BruterIP {
+	res := make(map[string]BruterIP)
+	entries, err := this.Store.List(storeBruteErr)
+	if err != nil {
+		this.fail(err)
+	}
+	for _, e := range entries {
+		ip := strings.TrimPrefix(e.Key, storeBruteErr)
+		res[ip] = BruterIP{IP: ip, Err: int(e.Value), LastTime: e.Expire.Add(-time.Duration(this.MaxTime) * time.Second)}
+	}
+	return res
+}
+
+// 處理函數標記的結果
+const (
+	bruteUnset = iota
+	bruteFailed
+	bruteOK
+)
+
+// Protect標記在Responser中的狀態
+type bruteSignal struct {
+	mu     sync.Mutex
+	result int
+	user   string
+}
+
+// * 中間件，已封禁返回429；響應狀態在statuses中時記錄失敗，默認401、403；處理函數調用BruteOK時只清除賬號的計數
+// * 失敗過的客戶端在處理前按Delay延遲；Basic認證的用戶名同時按賬號計數
+func (this *Bruter) Protect(statuses ...int) MiddlewareFunc {
+	if len(statuses) == 0 {
+		statuses = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	return func(r *http.Request) error {
+		rw := GetResponser(r)
+		keys := this.Keys(r, "")
+		if user, _, ok := r.BasicAuth(); ok && user != "" {
+			keys = append(keys, BruteUser(user))
+		}
+		if until, ok := this.BlockedUntil(keys...); ok {
+			if rw != nil {
+				SetRateHeaders(rw.Header(), RateResult{Limit: this.MaxErr, Reset: time.Until(until)})
+			}
+			return this.tooManyRequests()
 		}
+		if delay := this.Delay(keys...); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return r.Context().Err()
+			}
+		}
+		// 不經Apper時無法取得響應狀態，仍檢查封禁和延遲，但不記錄失敗
+		if rw == nil {
+			this.noRw.Do(func() { this.fail(ErrNoResponser) })
+			return nil
+		}
+		sig := &bruteSignal{}
+		rw.brute = sig
+		rw.After(func(status int) {
+			sig.mu.Lock()
+			result, user := sig.result, sig.user
+			sig.mu.Unlock()
+			keys := keys
+			if user != "" {
+				keys = append(keys, BruteUser(user))
+			}
+			switch {
+			case result == bruteFailed || result == bruteUnset && slices.Contains(statuses, status):
+				this.SetStatus(keys...)
+			case result == bruteOK:
+				// 只清除賬號的計數
+				var users []string
+				for _, key := range keys {
+					if strings.HasPrefix(key, bruteUser) {
+						users = append(users, key)
+					}
+				}
+				this.Success(users...)
+			}
+		})
+		return nil
+	}
+}
+
+// 429錯誤，Body不為空時為JSON
+func (this *Bruter) tooManyRequests() *HttpError {
+	if this.Body != "" {
+		return &HttpError{Code: http.StatusTooManyRequests, Message: this.Body, ContentType: "application/json; charset=utf-8"}
 	}
-	for ip, _ := range this.BlockIps {
-		if time.Since(this.BlockIps[ip]) > 24 * time.Hour {
-			delete(this.BlockIps, ip)
+	return NewHttpError(http.StatusTooManyRequests, "Too Many Requests")
+}
+
+// 請求的Protect狀態，未經Protect時返回nil
+func bruteSignalOf(r *http.Request) *bruteSignal {
+	if rw := GetResponser(r); rw != nil {
+		return rw.brute
+	}
+	return nil
+}
+
+func (this *bruteSignal) set(result int) {
+	if this != nil {
+		this.mu.Lock()
+		this.result = result
+		this.mu.Unlock()
+	}
+}
+
+// BruteFail 標記本次請求失敗，不論響應狀態都記錄到Protect
+// BruteFail marks the request as a failure for Protect regardless of the response status
+func BruteFail(r *http.Request) {
+	bruteSignalOf(r).set(bruteFailed)
+}
+
+// BruteOK 標記本次請求成功，Protect清除賬號的計數，IP和路由的計數保留
+// BruteOK marks the request as a success, Protect clears the account counters but keeps the IP and route counters
+func BruteOK(r *http.Request) {
+	bruteSignalOf(r).set(bruteOK)
+}
+
+// * Protect同時按賬號計數本次請求，返回該賬號是否已封禁
+func (this *Bruter) Account(r *http.Request, user string) bool {
+	if sig := bruteSignalOf(r); sig != nil && user != "" {
+		sig.mu.Lock()
+		sig.user = user
+		sig.mu.Unlock()
+	}
+	return user != "" && this.IsBlocked(BruteUser(user))
+}
+
+// * 清除過期IP，Store自行過期時無需清理
+func (this *Bruter) Clear() {
+	clearStore(this.Store)
+}
+
+// 存儲出錯
+func (this *Bruter) fail(err error) {
+	if this.OnError != nil {
+		this.OnError(err)
+	}
+}
+
+// * 後台定時清理過期數據
+func (this *Bruter) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case now := <-ticker.C:
+			this.Clear()
+			this.expireBlocks("brute", now)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// * 停止後台清理，Store需另行關閉
+func (this *Bruter) Close() {
+	this.closeOnce.Do(func() { close(this.stop) })
+}
+
+func (this *Bruter) String() string {
+	return fmt.Sprintf("&{MaxIp:%d MaxErr:%d UserErr:%d RouteErr:%d MaxTime:%d Lockouts:%v Forget:%s DelayBase:%s DelayMax:%s Store:%T}",
+		this.MaxIp, this.MaxErr, this.UserErr, this.RouteErr, this.MaxTime, this.Lockouts, this.Forget, this.DelayBase, this.DelayMax, this.Store)
+}
@@ -0,0 +1,317 @@
+package goweber
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBruterBlock(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 3
+	for i := 0; i < 3; i++ {
+		if bruter.IsBlocked("1.2.3.4") {
+			t.Fatalf("blocked after %d errors", i)
+		}
+		bruter.SetStatus("1.2.3.4")
+	}
+	until, ok := bruter.BlockedUntil("1.2.3.4")
+	if !ok || time.Until(until) < 23*time.Hour {
+		t.Fatalf("until %s %v", until, ok)
+	}
+	if bruter.IsBlocked("5.6.7.8") {
+		t.Fatal("other ip blocked")
+	}
+}
+
+func TestBruterWindow(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 2
+	bruter.SetStatus("1.2.3.4")
+	// 窗口過期後重新計數
+	key := storeBruteErr + "1.2.3.4"
+	bruter.Store.(*MemoryStore).data.Do(key, func(m map[string]StoreEntry) {
+		e := m[key]
+		e.Expire = time.Now().Add(-time.Minute)
+		m[key] = e
+	})
+	bruter.SetStatus("1.2.3.4")
+	if bruter.IsBlocked("1.2.3.4") {
+		t.Fatal("errors outside the window counted")
+	}
+}
+
+func TestBruterAccount(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.UserErr = 3
+	// 撞庫：同一賬號分散在多個IP，單個IP未達閾值
+	for i := 0; i < 3; i++ {
+		ip := "198.51.100." + strconv.Itoa(i)
+		bruter.SetStatus(ip, BruteUser("alice"))
+		if bruter.IsBlocked(ip) {
+			t.Fatalf("%s blocked", ip)
+		}
+	}
+	if !bruter.IsBlocked("203.0.113.1", BruteUser("alice")) {
+		t.Fatal("account not blocked")
+	}
+	if bruter.IsBlocked("203.0.113.1", BruteUser("bob")) {
+		t.Fatal("other account blocked")
+	}
+	if _, ok := bruter.Blocked()["user:alice"]; !ok {
+		t.Fatalf("blocked %v", bruter.Blocked())
+	}
+}
+
+func TestBruterRoute(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 100
+	bruter.RouteErr = 2
+	// NAT出口：一個用戶在/login反復失敗，不影響同一IP的其他路由
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	keys := bruter.Keys(r, "")
+	if len(keys) != 2 || keys[1] != BruteRoute("192.0.2.1", "/login") {
+		t.Fatalf("keys %v", keys)
+	}
+	bruter.SetStatus(keys...)
+	bruter.SetStatus(keys...)
+	if !bruter.IsBlocked(keys...) {
+		t.Fatal("route not blocked")
+	}
+	if bruter.IsBlocked("192.0.2.1", BruteRoute("192.0.2.1", "/reset")) {
+		t.Fatal("other route blocked")
+	}
+	// 0為不按該維度計數
+	bruter.UserErr = 0
+	for i := 0; i < 10; i++ {
+		bruter.SetStatus(BruteUser("carol"))
+	}
+	if bruter.IsBlocked(BruteUser("carol")) || len(bruter.Monitored()) != 1 {
+		t.Fatalf("disabled dimension counted: %v", bruter.Monitored())
+	}
+}
+
+// 并發讀寫同一批IP，需使用go test -race運行
+func TestBruterConcurrent(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxIp = 100
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				ip := "10.1." + strconv.Itoa(g) + "." + strconv.Itoa(i%150)
+				bruter.SetStatus(ip)
+				bruter.IsBlocked(ip)
+				if i%500 == 0 {
+					bruter.Clear()
+					bruter.Blocked()
+					bruter.Monitored()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(bruter.Blocked()) == 0 {
+		t.Fatal("nothing blocked")
+	}
+}
+
+func BenchmarkBruterSetStatus(b *testing.B) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxIp = 200000
+	ips := benchIps(100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			bruter.SetStatus(ips[i%len(ips)])
+			i++
+		}
+	})
+}
+
+func BenchmarkBruterIsBlocked(b *testing.B) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	ips := benchIps(100000)
+	for i, ip := range ips {
+		if i%2 == 0 {
+			bruter.Store.SetBlock(storeBruteBlock+ip, time.Now().Add(time.Hour))
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			bruter.IsBlocked(ips[i%len(ips)])
+			i++
+		}
+	})
+}
+
+func TestBruterLockout(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 1
+	bruter.Lockouts = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+	// 重複封禁時長遞增，超出列表時使用最後一個
+	for _, want := range []time.Duration{time.Minute, 5 * time.Minute, time.Hour, time.Hour} {
+		bruter.SetStatus("192.0.2.1")
+		until, ok := bruter.BlockedUntil("192.0.2.1")
+		if d := time.Until(until); !ok || d > want || d < want-time.Second {
+			t.Fatalf("lockout %s want %s", d, want)
+		}
+		bruter.Unblock("192.0.2.1", "test")
+	}
+	// 其他key單獨計算
+	bruter.SetStatus("192.0.2.2")
+	if until, _ := bruter.BlockedUntil("192.0.2.2"); time.Until(until) > time.Minute {
+		t.Fatalf("other key lockout %s", time.Until(until))
+	}
+}
+
+func TestBruterConfig(t *testing.T) {
+	app := newTestApp(t)
+	bruter := app.GetBruter()
+	if len(bruter.Lockouts) != 4 || bruter.Lockouts[0] != time.Minute || bruter.DelayBase != 200*time.Millisecond {
+		t.Fatalf("bruter %s", bruter)
+	}
+	if bruter.Store != app.GetStore() || bruter.Iper != app.Iper {
+		t.Fatal("bruter not sharing the apper's store and ip resolver")
+	}
+}
+
+func TestBruterSuccessDelay(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 10
+	bruter.DelayBase = 100 * time.Millisecond
+	bruter.DelayMax = 300 * time.Millisecond
+	keys := []string{"192.0.2.1", BruteUser("alice")}
+	if d := bruter.Delay(keys...); d != 0 {
+		t.Fatalf("delay without errors %s", d)
+	}
+	for _, want := range []time.Duration{100, 200, 300, 300} {
+		bruter.SetStatus(keys...)
+		if d := bruter.Delay(keys...); d != want*time.Millisecond {
+			t.Fatalf("delay %s want %dms", d, want)
+		}
+	}
+	// 登錄成功清除計數
+	bruter.Success(keys...)
+	if d := bruter.Delay(keys...); d != 0 || len(bruter.Monitored()) != 0 {
+		t.Fatalf("after success delay %s monitored %v", d, bruter.Monitored())
+	}
+}
+
+func TestBruterProtect(t *testing.T) {
+	app := newTestApp(t)
+	app.Iper.Trusted, _ = ParseCIDRs("192.0.2.1")
+	bruter := app.GetBruter()
+	bruter.MaxErr, bruter.RouteErr, bruter.UserErr = 100, 3, 3
+	bruter.DelayBase = 0
+	app.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+		user := r.FormValue("user")
+		if bruter.Account(r, user) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.FormValue("password") != "ok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		BruteOK(r)
+	}, bruter.Protect())
+	app.Get("/home", func(w http.ResponseWriter, r *http.Request) {}, bruter.Protect())
+	app.Post("/otp", func(w http.ResponseWriter, r *http.Request) {
+		BruteFail(r) // 200響應中返回錯誤
+	}, bruter.Protect())
+	login := func(ip, query string) int {
+		return serve(app, "POST", "/login?"+query, http.Header{"X-Forwarded-For": {ip}}).Code
+	}
+
+	// 登錄成功只清除賬號的計數，IP和路由的計數保留
+	login("198.51.100.1", "user=bob")
+	login("198.51.100.1", "user=bob")
+	if login("198.51.100.1", "user=bob&password=ok") != 200 {
+		t.Fatal("login failed")
+	}
+	monitored := bruter.Monitored()
+	if _, ok := monitored[BruteUser("bob")]; ok || monitored["198.51.100.1"].Err != 2 {
+		t.Fatalf("after success: %v", monitored)
+	}
+	// 其他成功的請求不清除計數
+	if w := serve(app, "GET", "/home", http.Header{"X-Forwarded-For": {"198.51.100.1"}}); w.Code != 200 {
+		t.Fatalf("home %d", w.Code)
+	}
+	if bruter.Monitored()["198.51.100.1"].Err != 2 {
+		t.Fatalf("unrelated success cleared counters: %v", bruter.Monitored())
+	}
+	// 路由封禁
+	for i := 0; i < 3; i++ {
+		login("198.51.100.2", "user=u"+strconv.Itoa(i))
+	}
+	w := serve(app, "POST", "/login?password=ok", http.Header{"X-Forwarded-For": {"198.51.100.2"}})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Limit") != "100" {
+		t.Fatalf("blocked route: %d %v", w.Code, w.Header())
+	}
+	// 與Rater相同的429響應內容
+	if !strings.Contains(w.Body.String(), `"code":429`) || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("blocked body %q", w.Body.String())
+	}
+	if login("198.51.100.3", "password=ok") != 200 {
+		t.Fatal("other ip blocked")
+	}
+	// 賬號封禁
+	for i := 4; i < 7; i++ {
+		login("198.51.100."+strconv.Itoa(i), "user=alice")
+	}
+	if login("198.51.100.8", "user=alice&password=ok") != http.StatusTooManyRequests {
+		t.Fatal("account not blocked")
+	}
+	// 明確標記失敗
+	for i := 0; i < 3; i++ {
+		serve(app, "POST", "/otp", http.Header{"X-Forwarded-For": {"198.51.100.9"}})
+	}
+	if w := serve(app, "POST", "/otp", http.Header{"X-Forwarded-For": {"198.51.100.9"}}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("signalled failures: %d", w.Code)
+	}
+}
+
+func TestBruterProtectNoResponser(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 1
+	var reported []error
+	bruter.OnError = func(err error) { reported = append(reported, err) }
+	protect := bruter.Protect()
+	// 不經Apper時仍放行未封禁的請求，并報告一次無法記錄失敗
+	for i := 0; i < 2; i++ {
+		if err := protect(httptest.NewRequest("POST", "/login", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrNoResponser) {
+		t.Fatalf("reported %v", reported)
+	}
+	// 已封禁的請求仍返回429
+	bruter.SetStatus("192.0.2.1")
+	err := protect(httptest.NewRequest("POST", "/login", nil))
+	if he, ok := err.(*HttpError); !ok || he.Code != http.StatusTooManyRequests {
+		t.Fatalf("blocked: %v", err)
+	}
+}
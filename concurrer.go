@@ -0,0 +1,164 @@
+// * 並發限制
+// * 同時處理的請求數達到上限時進入等待隊列，隊列已滿或等待超時返回503及Retry-After
+// * 自適應模式(AIMD)：響應時間超過Target時上限乘以Decrease(每個Target周期最多一次)，否則每處理完當前上限個請求加1，最多Limit，最少MinLimit
+// * 下游變慢時並發上限隨之降低，多餘的請求快速失敗，避免拖垮整個服務
+// * 作為中間件使用，響應結束時釋放，可用於全局或單個路由
+package goweber
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Concurrer 並發限制，參數需在使用前設置
+// Concurrer limits in-flight requests with a bounded wait queue and optional AIMD adaptation
+type Concurrer struct {
+	Limit      int           // 最大並發數，自適應時為上限
+	Queue      int           // 等待隊列長度，0為不等待
+	Timeout    time.Duration // 排隊超時
+	RetryAfter int           // 503響應的Retry-After秒
+	Adaptive   bool          // 是否按響應時間調整並發數
+	MinLimit   int           // 自適應時的最小並發數
+	Target     time.Duration // 自適應的目標響應時間
+	Decrease   float64       // 超過目標時的乘數
+	mu         sync.Mutex
+	inflight   int
+	current    float64         // 當前並發上限
+	waiters    []chan struct{} // 先進先出
+	decreased  time.Time       // 上次減少的時間
+}
+
+// ErrConcurrency 並發已滿
+// ErrConcurrency is returned when the limiter is saturated
+var ErrConcurrency = errors.New("concurrency limit reached")
+
+func NewConcurrer(limit int) *Concurrer {
+	return &Concurrer{
+		Limit:      limit,
+		Queue:      limit,
+		Timeout:    time.Second,
+		RetryAfter: 1,
+		MinLimit:   1,
+		Target:     500 * time.Millisecond,
+		Decrease:   0.9,
+	}
+}
+
+// Acquire 獲取一個並發名額，需排隊時最多等待Timeout，返回的release在處理結束時調用
+// Acquire takes a slot, waiting up to Timeout in the queue, call release with the handling time when done
+func (this *Concurrer) Acquire(r *http.Request) (release func(latency time.Duration), err error) {
+	this.mu.Lock()
+	if this.inflight < this.limit() && len(this.waiters) == 0 {
+		this.inflight++
+		this.mu.Unlock()
+		return this.release, nil
+	}
+	if len(this.waiters) >= this.Queue {
+		this.mu.Unlock()
+		return nil, ErrConcurrency
+	}
+	ch := make(chan struct{})
+	this.waiters = append(this.waiters, ch)
+	this.mu.Unlock()
+
+	timer := time.NewTimer(this.Timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return this.release, nil
+	case <-timer.C:
+		err = ErrConcurrency
+	case <-r.Context().Done():
+		err = r.Context().Err()
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, w := range this.waiters {
+		if w == ch {
+			this.waiters = append(this.waiters[:i], this.waiters[i+1:]...)
+			return nil, err
+		}
+	}
+	// 超時的同時已分到名額，歸還
+	this.inflight--
+	this.wake()
+	return nil, err
+}
+
+// Check 中間件，並發已滿時返回503，響應結束時釋放
+// Check is the middleware, returning 503 when saturated and releasing the slot when the response is finished
+func (this *Concurrer) Check(r *http.Request) error {
+	rw := GetResponser(r)
+	if rw == nil {
+		return nil
+	}
+	release, err := this.Acquire(r)
+	if err != nil {
+		rw.Header().Set("Retry-After", strconv.Itoa(this.RetryAfter))
+		return NewHttpError(http.StatusServiceUnavailable, "Service Unavailable")
+	}
+	start := time.Now()
+	rw.After(func(status int) {
+		release(time.Since(start))
+	})
+	return nil
+}
+
+// 歸還名額，自適應時按響應時間調整上限
+func (this *Concurrer) release(latency time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.Adaptive {
+		this.limit()
+		if latency > this.Target {
+			// 同一批慢請求只減少一次
+			if now := time.Now(); now.Sub(this.decreased) >= this.Target {
+				this.current = max(this.current*this.Decrease, float64(this.MinLimit))
+				this.decreased = now
+			}
+		} else {
+			this.current = min(this.current+1/this.current, float64(this.Limit))
+		}
+	}
+	this.inflight--
+	this.wake()
+}
+
+// 按先後順序把空出的名額交給等待者，需持有鎖
+func (this *Concurrer) wake() {
+	for len(this.waiters) > 0 && this.inflight < this.limit() {
+		ch := this.waiters[0]
+		this.waiters = this.waiters[1:]
+		this.inflight++
+		close(ch)
+	}
+}
+
+// 當前並發上限，需持有鎖
+func (this *Concurrer) limit() int {
+	if !this.Adaptive {
+		return this.Limit
+	}
+	if this.current <= 0 || this.current > float64(this.Limit) {
+		this.current = float64(this.Limit)
+	}
+	return max(int(this.current), this.MinLimit, 1)
+}
+
+// Stats 處理中、等待中的請求數及當前並發上限
+// Stats returns the in-flight and queued request counts and the current limit
+func (this *Concurrer) Stats() (inflight, waiting, limit int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.inflight, len(this.waiters), this.limit()
+}
+
+func (this *Concurrer) String() string {
+	inflight, waiting, limit := this.Stats()
+	return fmt.Sprintf("&{Limit:%d Queue:%d Timeout:%s Adaptive:%v MinLimit:%d Target:%s InFlight:%d Waiting:%d Current:%d}",
+		this.Limit, this.Queue, this.Timeout, this.Adaptive, this.MinLimit, this.Target, inflight, waiting, limit)
+}
@@ -0,0 +1,119 @@
+package goweber
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrerQueue(t *testing.T) {
+	c := NewConcurrer(1)
+	c.Queue = 1
+	c.Timeout = 50 * time.Millisecond
+	r := httptest.NewRequest("GET", "/", nil)
+	release, err := c.Acquire(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan error, 1)
+	go func() {
+		rel, err := c.Acquire(r)
+		if err == nil {
+			defer rel(0)
+		}
+		got <- err
+	}()
+	for {
+		if _, waiting, _ := c.Stats(); waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// 隊列已滿時立即拒絕
+	if _, err := c.Acquire(r); err != ErrConcurrency {
+		t.Fatalf("queue full: %v", err)
+	}
+	release(0)
+	if err := <-got; err != nil {
+		t.Fatalf("queued: %v", err)
+	}
+	// 排隊超時
+	release, _ = c.Acquire(r)
+	start := time.Now()
+	if _, err := c.Acquire(r); err != ErrConcurrency || time.Since(start) < c.Timeout {
+		t.Fatalf("timeout: %v after %s", err, time.Since(start))
+	}
+	release(0)
+	if inflight, waiting, _ := c.Stats(); inflight != 0 || waiting != 0 {
+		t.Fatalf("leaked %d %d", inflight, waiting)
+	}
+}
+
+func TestConcurrerAdaptive(t *testing.T) {
+	c := NewConcurrer(10)
+	c.Adaptive = true
+	c.MinLimit = 2
+	c.Target = time.Hour
+	r := httptest.NewRequest("GET", "/", nil)
+	slow := func() {
+		release, err := c.Acquire(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release(2 * time.Hour)
+	}
+	slow()
+	slow() // 同一周期内只減少一次
+	if _, _, limit := c.Stats(); limit != 9 {
+		t.Fatalf("limit %d", limit)
+	}
+	for i := 0; i < 20; i++ {
+		c.decreased = time.Time{}
+		slow()
+	}
+	if _, _, limit := c.Stats(); limit != 2 {
+		t.Fatalf("min limit %d", limit)
+	}
+	// 快速響應時逐步恢復
+	for i := 0; i < 10; i++ {
+		release, _ := c.Acquire(r)
+		release(time.Millisecond)
+	}
+	if _, _, limit := c.Stats(); limit < 3 || limit > 10 {
+		t.Fatalf("recovered limit %d", limit)
+	}
+}
+
+func TestConcurrencyServe(t *testing.T) {
+	app := newTestApp(t)
+	c := NewConcurrer(2)
+	c.Queue = 0
+	app.Use(c.Check)
+	hold := make(chan struct{})
+	app.Get("/slow", func(w http.ResponseWriter, r *http.Request) { <-hold })
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(app, "GET", "/slow", nil)
+		}()
+	}
+	for {
+		if inflight, _, _ := c.Stats(); inflight == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w := serve(app, "GET", "/slow", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("saturated: %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(hold)
+	wg.Wait()
+	if inflight, _, _ := c.Stats(); inflight != 0 {
+		t.Fatalf("not released: %d", inflight)
+	}
+}
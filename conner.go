@@ -0,0 +1,243 @@
+// * 連接數限制
+// * Rater按請求限流，單個IP仍可打開大量空閑的keep-alive連接佔用資源
+// * 包裝監聽器，限制總連接數和每個IP的連接數，超過時直接關閉新連接
+// * 空閑連接回收：讀寫均無數據超過Idle的連接被關閉，http.Server.ConnState設為ConnState後只回收請求之間空閑的連接，處理中的請求和被接管的連接(如WebSocket)不受影響
+// * 位於PROXY協議包裝之後，按真實客戶端地址計數；IPv6可用Prefixer按前綴計數，允許名單不受每IP限制
+package goweber
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conner 連接數限制，參數需在Listener前設置，0為不限制
+// Conner limits total and per-IP connections at the listener and reaps idle connections
+type Conner struct {
+	MaxConns int           // 總連接數
+	MaxPerIP int           // 每個IP的連接數
+	Idle     time.Duration // 空閑超時
+	Prefixer *Prefixer     // 地址聚合，nil為按單個地址
+	Accesser *Accesser     // 允許名單不受每IP限制
+	// 拒絕連接時調用，reason為total或ip
+	OnReject func(addr net.Addr, reason string)
+	perIP    *shardMap[int]
+	mu       sync.Mutex
+	conns    map[*connTrack]struct{}
+	active   atomic.Int64
+	accepted atomic.Int64
+	rejTotal atomic.Int64
+	rejIP    atomic.Int64
+	reaped   atomic.Int64
+}
+
+// ConnStats 連接統計
+// ConnStats are the connection metrics
+type ConnStats struct {
+	Active        int64 `json:"active"`         // 當前連接數
+	Accepted      int64 `json:"accepted"`       // 接受的連接總數
+	RejectedTotal int64 `json:"rejected_total"` // 因總連接數拒絕
+	RejectedIP    int64 `json:"rejected_ip"`    // 因每IP連接數拒絕
+	Reaped        int64 `json:"reaped"`         // 空閑回收
+}
+
+// ConnState 跟蹤連接狀態，設為http.Server.ConnState，處理請求中和被接管的連接不被回收
+// ConnState tracks connection states, set it as http.Server.ConnState so connections serving a request or hijacked are not reaped
+func (this *Conner) ConnState(c net.Conn, state http.ConnState) {
+	for {
+		if tc, ok := c.(*connTrack); ok {
+			switch state {
+			case http.StateActive, http.StateHijacked:
+				tc.busy.Store(true) // 被接管的連接(如WebSocket)由處理函數管理，不回收
+			case http.StateIdle:
+				tc.busy.Store(false)
+				tc.touch()
+			}
+			return
+		}
+		// TLS等包裝的連接
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		c = nc.NetConn()
+	}
+}
+
+func NewConner() *Conner {
+	return &Conner{
+		MaxConns: 10000,
+		MaxPerIP: 100,
+		Idle:     2 * time.Minute,
+		perIP:    newShardMap[int](),
+		conns:    make(map[*connTrack]struct{}),
+	}
+}
+
+// Listener 包裝監聽器，關閉時停止空閑回收
+// Listener wraps ln, the idle reaper stops when it is closed
+func (this *Conner) Listener(ln net.Listener) net.Listener {
+	l := &connListener{Listener: ln, conner: this, done: make(chan struct{})}
+	if this.Idle > 0 {
+		go this.reap(l.done)
+	}
+	return l
+}
+
+// Stats 連接統計
+// Stats returns the connection metrics
+func (this *Conner) Stats() ConnStats {
+	return ConnStats{
+		Active:        this.active.Load(),
+		Accepted:      this.accepted.Load(),
+		RejectedTotal: this.rejTotal.Load(),
+		RejectedIP:    this.rejIP.Load(),
+		Reaped:        this.reaped.Load(),
+	}
+}
+
+// 計數新連接，超過限制時返回拒絕原因
+func (this *Conner) admit(c net.Conn) (*connTrack, string) {
+	if n := this.active.Add(1); this.MaxConns > 0 && n > int64(this.MaxConns) {
+		this.active.Add(-1)
+		this.rejTotal.Add(1)
+		return nil, "total"
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		host = c.RemoteAddr().String()
+	}
+	key := this.Prefixer.Key(host)
+	limited := this.MaxPerIP > 0 && this.Accesser.Check(host) != AccessAllow
+	ok := true
+	this.perIP.Do(key, func(m map[string]int) {
+		if limited && m[key] >= this.MaxPerIP {
+			ok = false
+			return
+		}
+		m[key]++
+	})
+	if !ok {
+		this.active.Add(-1)
+		this.rejIP.Add(1)
+		return nil, "ip"
+	}
+	this.accepted.Add(1)
+	tc := &connTrack{Conn: c, conner: this, key: key}
+	tc.touch()
+	this.mu.Lock()
+	this.conns[tc] = struct{}{}
+	this.mu.Unlock()
+	return tc, ""
+}
+
+// 連接關閉，減少計數
+func (this *Conner) release(tc *connTrack) {
+	this.perIP.Do(tc.key, func(m map[string]int) {
+		if m[tc.key]--; m[tc.key] <= 0 {
+			delete(m, tc.key)
+		}
+	})
+	this.active.Add(-1)
+	this.mu.Lock()
+	delete(this.conns, tc)
+	this.mu.Unlock()
+}
+
+// 定時關閉空閑連接
+func (this *Conner) reap(done chan struct{}) {
+	ticker := time.NewTicker(max(this.Idle/2, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			var idle []*connTrack
+			this.mu.Lock()
+			for tc := range this.conns {
+				if !tc.busy.Load() && now.UnixNano()-tc.last.Load() > int64(this.Idle) {
+					idle = append(idle, tc)
+				}
+			}
+			this.mu.Unlock()
+			for _, tc := range idle {
+				this.reaped.Add(1)
+				tc.Close()
+			}
+		}
+	}
+}
+
+func (this *Conner) String() string {
+	return fmt.Sprintf("&{MaxConns:%d MaxPerIP:%d Idle:%s Stats:%+v}", this.MaxConns, this.MaxPerIP, this.Idle, this.Stats())
+}
+
+type connListener struct {
+	net.Listener
+	conner    *Conner
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// 超過限制的連接直接關閉，繼續等待下一個
+func (this *connListener) Accept() (net.Conn, error) {
+	for {
+		c, err := this.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tc, reason := this.conner.admit(c)
+		if tc != nil {
+			return tc, nil
+		}
+		c.Close()
+		if this.conner.OnReject != nil {
+			this.conner.OnReject(c.RemoteAddr(), reason)
+		}
+	}
+}
+
+func (this *connListener) Close() error {
+	this.closeOnce.Do(func() { close(this.done) })
+	return this.Listener.Close()
+}
+
+// 記錄最後讀寫時間的連接
+type connTrack struct {
+	net.Conn
+	conner    *Conner
+	key       string
+	last      atomic.Int64
+	busy      atomic.Bool // 處理請求中
+	closeOnce sync.Once
+}
+
+func (this *connTrack) touch() {
+	this.last.Store(time.Now().UnixNano())
+}
+
+func (this *connTrack) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	if n > 0 {
+		this.touch()
+	}
+	return n, err
+}
+
+func (this *connTrack) Write(p []byte) (int, error) {
+	n, err := this.Conn.Write(p)
+	if n > 0 {
+		this.touch()
+	}
+	return n, err
+}
+
+func (this *connTrack) Close() error {
+	err := this.Conn.Close()
+	this.closeOnce.Do(func() { this.conner.release(this) })
+	return err
+}
@@ -0,0 +1,224 @@
+package goweber
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 監聽本地端口，接受的連接交給conns
+func connListen(t *testing.T, c *Conner) (net.Listener, chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = c.Listener(ln)
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return ln, conns
+}
+
+// 等待連接被服務端關閉
+func connClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("連接應被關閉: %v", err)
+	}
+}
+
+func TestConnerLimit(t *testing.T) {
+	c := NewConner()
+	c.MaxConns = 3
+	c.MaxPerIP = 2
+	c.Idle = 0
+	c.Accesser = NewAccesser()
+	ln, conns := connListen(t, c)
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	<-conns
+	server := <-conns
+	// 同一IP的第3個連接被拒絕
+	connClosed(t, clients[2])
+	if s := c.Stats(); s.Active != 2 || s.Accepted != 2 || s.RejectedIP != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+	// 關閉後釋放名額，重複關閉只計一次
+	server.Close()
+	server.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-conns
+	if s := c.Stats(); s.Active != 2 || s.Accepted != 3 {
+		t.Fatalf("stats = %+v", s)
+	}
+
+	// 允許名單不受每IP限制，但受總連接數限制
+	c.Accesser.Allow = []string{"127.0.0.1"}
+	if err := c.Accesser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	<-conns
+	connClosed(t, clients[4])
+	if s := c.Stats(); s.Active != 3 || s.RejectedTotal != 1 || s.RejectedIP != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestConnerIdle(t *testing.T) {
+	c := NewConner()
+	c.Idle = 50 * time.Millisecond
+	ln, conns := connListen(t, c)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-conns
+	connClosed(t, conn)
+	if s := c.Stats(); s.Reaped != 1 || s.Active != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestConnServe(t *testing.T) {
+	app := newTestApp(t)
+	app.conner = NewConner()
+	app.conner.MaxPerIP = 1
+	app.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = app.conner.Listener(ln)
+	server := &http.Server{Handler: app}
+	go server.Serve(ln)
+	defer server.Close()
+
+	// keep-alive連接佔用名額，第二個客戶端被拒絕
+	url := "http://" + ln.Addr().String() + "/"
+	keep := &http.Client{Transport: &http.Transport{}}
+	resp, err := keep.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	other := &http.Client{Transport: &http.Transport{}}
+	if _, err := other.Get(url); err == nil {
+		t.Fatal("第二個連接應被拒絕")
+	}
+	if s := app.conner.Stats(); s.RejectedIP == 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+	// 第一個客戶端復用連接
+	resp, err = keep.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestConnerIdleRequest(t *testing.T) {
+	c := NewConner()
+	c.Idle = 50 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = c.Listener(ln)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond) // 處理時間超過Idle
+			io.WriteString(w, "done")
+		}),
+		ConnState: c.ConnState,
+	}
+	go server.Serve(ln)
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" || c.Stats().Reaped != 0 {
+		t.Fatalf("body %q stats %+v", body, c.Stats())
+	}
+	// 請求結束後空閑的keep-alive連接仍被回收
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Reaped == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := c.Stats(); s.Reaped != 1 || s.Active != 0 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestConnerIdleHijack(t *testing.T) {
+	c := NewConner()
+	c.Idle = 50 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = c.Listener(ln)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+			buf.Flush()
+			time.Sleep(300 * time.Millisecond) // 會話安靜超過Idle
+			conn.Write([]byte("hi"))
+		}),
+		ConnState: c.ConnState,
+	}
+	go server.Serve(ln)
+	defer server.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	body, _ := io.ReadAll(conn)
+	if !strings.HasSuffix(string(body), "hi") || c.Stats().Reaped != 0 {
+		t.Fatalf("body %q stats %+v", body, c.Stats())
+	}
+}
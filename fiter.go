@@ -51,7 +51,7 @@ func (f *FileUploader) HandleUpload(r *http.Request) ([]string, error) {
 	// 解析表单
 	err := r.ParseMultipartForm(f.MaxSize)
 	if err != nil {
-		return nil, fmt.Errorf("解析表单失败")
+		return nil, fmt.Errorf("解析表单失败: %w", err)
 	}
 
 	// 获取所有文件 (使用自定义字段名)
@@ -0,0 +1,51 @@
+package goweber
+
+import (
+	"net/http"
+)
+
+// Grouper 路由組，組内路由共用路徑前綴和中間件
+// Grouper is a route group sharing a path prefix and middleware
+type Grouper struct {
+	app    *Apper
+	prefix string
+	mid    []MiddlewareFunc
+}
+
+// Group 創建路由組，mid在路由自身的中間件之前執行
+// Group creates a route group, mid runs before the route's own middleware
+func (this *Apper) Group(prefix string, mid ...MiddlewareFunc) *Grouper {
+	return &Grouper{app: this, prefix: prefix, mid: mid}
+}
+
+// Group 創建子路由組，繼承前綴和中間件
+// Group creates a sub group inheriting the prefix and middleware
+func (this *Grouper) Group(prefix string, mid ...MiddlewareFunc) *Grouper {
+	all := append(append([]MiddlewareFunc{}, this.mid...), mid...)
+	return &Grouper{app: this.app, prefix: this.prefix + prefix, mid: all}
+}
+
+// Use 為組内之後注冊的路由添加中間件
+// Use adds middleware to routes registered on the group afterwards
+func (this *Grouper) Use(mid ...MiddlewareFunc) {
+	this.mid = append(this.mid, mid...)
+}
+
+// Get 注册GET请求的路由处理函数
+// Get registers the route handler function for GET requests
+func (this *Grouper) Get(path string, f http.HandlerFunc, mid ...MiddlewareFunc) {
+	this.Route("GET", path, f, mid...)
+}
+
+// Post 注册POST请求的路由处理函数
+// Post registers the route handler function for POST requests
+func (this *Grouper) Post(path string, f http.HandlerFunc, mid ...MiddlewareFunc) {
+	this.Route("POST", path, f, mid...)
+}
+
+// Route 注册指定HTTP方法的路由处理函数
+// Route registers the route handler function for the specified HTTP method
+func (this *Grouper) Route(method string, path string, f http.HandlerFunc, mid ...MiddlewareFunc) {
+	all := append(append([]MiddlewareFunc{}, this.mid...), mid...)
+	this.app.Route(method, this.prefix+path, f, all...)
+}
@@ -1,3 +1,5 @@
+//go:build ignore
+
 // v1.0.3 2026/7/22 backup
 package goweber
 
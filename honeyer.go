@@ -0,0 +1,107 @@
+// * 蜜罐
+// * 掃描器常探測/wp-admin、/.env、/phpmyadmin等路徑，訪問這些未注冊的路徑立即封禁IP，封禁寫入Rater的封禁列表
+// * 路徑以*結尾時按前綴匹配，不區分大小寫；以任何方法注冊的路由都不會被當作蜜罐
+// * 慢速響應(tarpit)：對蜜罐命中及已封禁的客戶端每隔Interval寫入一個字節，拖慢掃描器，而不是立即關閉連接
+// * 每個連接最多保持Duration，同時慢速響應的連接數不超過MaxTarpit，超過時正常響應
+package goweber
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Honeyer 蜜罐和慢速響應，參數需在使用前設置
+// Honeyer bans clients probing honeypot paths and tarpits known-bad clients
+type Honeyer struct {
+	Paths     []string      // 蜜罐路徑，以*結尾時按前綴匹配
+	Block     int           // 封禁秒
+	Rater     *Rater        // 封禁寫入Rater的封禁列表
+	Tarpit    bool          // 是否慢速響應
+	Interval  time.Duration // 慢速響應每個字節的間隔
+	Duration  time.Duration // 每個連接慢速響應的最長時間
+	MaxTarpit int           // 同時慢速響應的最大連接數
+	active    atomic.Int32
+}
+
+func NewHoneyer(rater *Rater) *Honeyer {
+	return &Honeyer{
+		Paths:     []string{"/wp-admin*", "/wp-login.php", "/xmlrpc.php", "/.env", "/.git/*", "/phpmyadmin*", "/pma*"},
+		Block:     86400,
+		Rater:     rater,
+		Interval:  time.Second,
+		Duration:  30 * time.Second,
+		MaxTarpit: 100,
+	}
+}
+
+// Match 是否蜜罐路徑
+// Match reports whether path is a honeypot path
+func (this *Honeyer) Match(path string) bool {
+	for _, p := range this.Paths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(path) >= len(prefix) && strings.EqualFold(path[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Trap 封禁訪問蜜罐的IP
+// Trap bans the client that requested a honeypot path
+func (this *Honeyer) Trap(ip, path string) {
+	until := time.Now().Add(time.Duration(this.Block) * time.Second)
+	this.Rater.block(ip, BanEvent{Source: "honey", Reason: "honeypot " + path, Count: 1, Limit: 1, Until: until})
+}
+
+// Drip 慢速響應，未開啓或連接數已滿時返回false，由調用者正常響應
+// Drip slowly writes a response, false when disabled or at capacity so the caller responds normally
+func (this *Honeyer) Drip(w http.ResponseWriter, r *http.Request) bool {
+	if !this.Tarpit {
+		return false
+	}
+	if this.active.Add(1) > int32(this.MaxTarpit) {
+		this.active.Add(-1)
+		return false
+	}
+	defer this.active.Add(-1)
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(this.Duration + this.Interval))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	timer := time.NewTimer(this.Duration)
+	defer timer.Stop()
+	ticker := time.NewTicker(this.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.Write([]byte{' '}); err != nil {
+			return true
+		}
+		if rc.Flush() != nil {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return true
+		case <-r.Context().Done():
+			return true
+		}
+	}
+}
+
+// Active 正在慢速響應的連接數
+// Active returns the number of connections being tarpitted
+func (this *Honeyer) Active() int {
+	return int(this.active.Load())
+}
+
+func (this *Honeyer) String() string {
+	return fmt.Sprintf("&{Paths:%v Block:%d Tarpit:%v Interval:%s Duration:%s MaxTarpit:%d}",
+		this.Paths, this.Block, this.Tarpit, this.Interval, this.Duration, this.MaxTarpit)
+}
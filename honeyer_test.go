@@ -0,0 +1,116 @@
+package goweber
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHoneyerMatch(t *testing.T) {
+	honey := NewHoneyer(nil)
+	for path, want := range map[string]bool{
+		"/wp-admin":           true,
+		"/WP-ADMIN/setup.php": true,
+		"/.env":               true,
+		"/.env.bak":           false,
+		"/.git/config":        true,
+		"/phpMyAdmin/":        true,
+		"/admin":              false,
+		"/":                   false,
+	} {
+		if honey.Match(path) != want {
+			t.Errorf("%s: %v", path, !want)
+		}
+	}
+}
+
+func TestHoneyServe(t *testing.T) {
+	app := newTestApp(t)
+	app.rate.SetStart(0) // 404封禁關閉時蜜罐的封禁仍然生效
+	app.honey = NewHoneyer(app.rate)
+	var events []BanEvent
+	app.rate.OnBlock = func(ev BanEvent) { events = append(events, ev) }
+	app.Get("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	app.Get("/.env", func(w http.ResponseWriter, r *http.Request) {}) // 已注冊的路由不是蜜罐
+	if w := serve(app, "GET", "/.env", nil); w.Code != 200 || len(events) != 0 {
+		t.Fatalf("registered route trapped: %d", w.Code)
+	}
+	// 其他方法請求已注冊的路徑也不是蜜罐
+	if w := serve(app, "POST", "/.env", nil); w.Code != http.StatusNotFound || len(events) != 0 {
+		t.Fatalf("registered route trapped for POST: %d", w.Code)
+	}
+	if w := serve(app, "GET", "/wp-login.php", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("honeypot %d", w.Code)
+	}
+	if len(events) != 1 || events[0].Source != "honey" || time.Until(events[0].Until) < 23*time.Hour {
+		t.Fatalf("events %+v", events)
+	}
+	if w := serve(app, "GET", "/ok", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("trapped client served: %d", w.Code)
+	}
+	// 允許名單不封禁
+	app.Accesser.Allow = []string{"198.51.100.0/24"}
+	app.Accesser.Load()
+	app.Iper.Trusted, _ = ParseCIDRs("192.0.2.1")
+	if w := serve(app, "GET", "/wp-login.php", http.Header{"X-Forwarded-For": {"198.51.100.1"}}); w.Code != http.StatusNotFound || len(events) != 1 {
+		t.Fatalf("allowlisted client trapped: %d", w.Code)
+	}
+}
+
+func TestHoneyTarpit(t *testing.T) {
+	honey := NewHoneyer(nil)
+	honey.Tarpit = true
+	honey.Interval = 10 * time.Millisecond
+	honey.Duration = 300 * time.Millisecond
+	honey.MaxTarpit = 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !honey.Drip(w, r) {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buf := new(strings.Builder)
+			b := make([]byte, 64)
+			for {
+				n, err := res.Body.Read(b)
+				buf.Write(b[:n])
+				if err != nil {
+					break
+				}
+			}
+			res.Body.Close()
+			if res.StatusCode == 200 && (buf.Len() < 5 || strings.TrimSpace(buf.String()) != "") {
+				t.Errorf("dripped %q", buf.String())
+			}
+			codes <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	n := map[int]int{}
+	for c := range codes {
+		n[c]++
+	}
+	// 超過MaxTarpit的連接正常響應
+	if n[200] != 2 || n[http.StatusTooManyRequests] != 1 || time.Since(start) < honey.Duration {
+		t.Fatalf("codes %v in %s", n, time.Since(start))
+	}
+	if honey.Active() != 0 {
+		t.Fatalf("active %d", honey.Active())
+	}
+}
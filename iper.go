@@ -0,0 +1,137 @@
+// * 客戶端IP解析
+// * 只有直接連接的地址屬於可信代理時才讀取轉發頭部，X-Forwarded-For和Forwarded從右向左跳過可信代理
+// * 返回的IP統一格式：IPv4映射的IPv6轉爲IPv4，去除端口和zone
+package goweber
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IP解析策略
+const (
+	IpRemote    = "remote"    // 只使用RemoteAddr
+	IpXff       = "xff"       // X-Forwarded-For
+	IpForwarded = "forwarded" // RFC 7239 Forwarded
+	IpRealIp    = "realip"    // X-Real-IP
+	IpHeader    = "header"    // 自定義頭部，如CF-Connecting-IP
+)
+
+// Iper 客戶端IP解析器，Apper、Rater、Bruter共用
+// Iper resolves the client IP, shared by Apper, Rater and Bruter
+type Iper struct {
+	Trusted  []*net.IPNet // 可信代理
+	Strategy string       // 解析策略
+	Header   string       // 自定義頭部名稱，Strategy為header時使用
+}
+
+// NewIper 創建IP解析器，默認使用X-Forwarded-For，未配置可信代理時等同於只使用RemoteAddr
+// NewIper creates a resolver using X-Forwarded-For, without trusted proxies it only uses RemoteAddr
+func NewIper() *Iper {
+	return &Iper{
+		Strategy: IpXff,
+	}
+}
+
+// GetClientIP 獲得客戶端IP，RemoteAddr無法解析或轉發頭部中只有可信代理和無效地址時返回unknown
+// GetClientIP returns the client IP, or unknown when RemoteAddr cannot be parsed or the forwarding header holds only trusted proxies and invalid hops
+func (this *Iper) GetClientIP(r *http.Request) string {
+	remote, ok := NormalizeIP(r.RemoteAddr)
+	if !ok {
+		return "unknown"
+	}
+	if this.Strategy == IpRemote || !this.IsTrusted(remote) {
+		return remote.String()
+	}
+	var client netip.Addr
+	switch this.Strategy {
+	case IpXff:
+		client = this.walk(remote, splitList(strings.Join(r.Header.Values("X-Forwarded-For"), ",")))
+	case IpForwarded:
+		client = this.walk(remote, forwardedFor(r.Header.Values("Forwarded")))
+	case IpRealIp:
+		client = this.single(remote, r.Header.Get("X-Real-IP"))
+	case IpHeader:
+		client = this.single(remote, r.Header.Get(this.Header))
+	default:
+		client = remote
+	}
+	if !client.IsValid() {
+		return "unknown"
+	}
+	return client.String()
+}
+
+// IsTrusted 判斷是否為可信代理
+// IsTrusted reports whether ip is a trusted proxy
+func (this *Iper) IsTrusted(ip netip.Addr) bool {
+	for _, n := range this.Trusted {
+		if n.Contains(ip.AsSlice()) {
+			return true
+		}
+	}
+	return false
+}
+
+// 從右向左跳過可信代理，第一個不可信地址為客戶端；跳過無效地址繼續查找，
+// 有無效地址且找不到不可信地址時返回無效地址，不把可信代理當作客戶端
+func (this *Iper) walk(remote netip.Addr, hops []string) netip.Addr {
+	client, invalid := remote, false
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := NormalizeIP(hops[i])
+		if !ok {
+			invalid = true
+			continue
+		}
+		if !this.IsTrusted(ip) {
+			return ip
+		}
+		client = ip
+	}
+	if invalid {
+		return netip.Addr{}
+	}
+	return client
+}
+
+// 可信代理設置的單值頭部
+func (this *Iper) single(remote netip.Addr, value string) netip.Addr {
+	if ip, ok := NormalizeIP(value); ok {
+		return ip
+	}
+	return remote
+}
+
+// 解析Forwarded頭部中的for參數，按出現順序返回
+// 例如：for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], "\""))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// NormalizeIP 解析并規範IP，支持端口、方括號、zone及IPv4映射的IPv6
+// NormalizeIP parses an address with optional port, brackets or zone and unmaps IPv4-mapped IPv6
+func NormalizeIP(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), "\"")
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.WithZone("").Unmap(), true
+}
@@ -0,0 +1,47 @@
+package goweber
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIperGetClientIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8,2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		strategy string
+		remote   string
+		header   map[string][]string
+		want     string
+	}{
+		{"remote only", IpXff, "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer ignores xff", IpXff, "203.0.113.5:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, "203.0.113.5"},
+		{"trusted peer single hop", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"spoofed left entry", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7"}}, "198.51.100.7"},
+		{"skip trusted hops", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.1.1.1", "10.2.2.2"}}, "198.51.100.7"},
+		{"all trusted", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"10.3.3.3, 10.1.1.1"}}, "10.3.3.3"},
+		{"invalid hop skipped", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage, 10.1.1.1"}}, "198.51.100.7"},
+		{"only invalid hops", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"garbage, 10.1.1.1"}}, "unknown"},
+		{"mapped ipv6", IpXff, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"::ffff:198.51.100.7"}}, "198.51.100.7"},
+		{"ipv6 zone and brackets", IpXff, "[2001:db8:ffff::1]:80", map[string][]string{"X-Forwarded-For": {"[fe80::1%eth0]:443"}}, "fe80::1"},
+		{"forwarded", IpForwarded, "10.0.0.2:80", map[string][]string{"Forwarded": {`for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https`}}, "2001:db8:cafe::17"},
+		{"forwarded obfuscated", IpForwarded, "10.0.0.2:80", map[string][]string{"Forwarded": {"for=_hidden, for=10.1.1.1"}}, "unknown"},
+		{"real ip", IpRealIp, "10.0.0.2:80", map[string][]string{"X-Real-Ip": {"198.51.100.7"}}, "198.51.100.7"},
+		{"remote strategy", IpRemote, "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "10.0.0.2"},
+		{"bad remote", IpXff, "bad", nil, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iper := NewIper()
+			iper.Trusted = trusted
+			iper.Strategy = tt.strategy
+			r := &http.Request{RemoteAddr: tt.remote, Header: http.Header(tt.header)}
+			if got := iper.GetClientIP(r); got != tt.want {
+				t.Fatalf("got %s want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// * 請求限流算法
+// * token 令牌桶：容量burst，每window秒補充rate個令牌，允許突發
+// * fixed 固定窗口：每window秒最多rate次，窗口邊界可能出現兩倍突發
+// * sliding 滑動窗口日志：任意window秒内最多rate次，精確但每個key保存rate個時間點
+package goweber
+
+import (
+	"errors"
+	"time"
+)
+
+// 限流算法
+const (
+	LimitToken   = "token"
+	LimitFixed   = "fixed"
+	LimitSliding = "sliding"
+)
+
+// RateResult 一次限流判斷的結果
+// RateResult is the outcome of one rate limit check
+type RateResult struct {
+	Allowed   bool          // 是否允許
+	Limit     int           // 窗口内允許的請求數
+	Remaining int           // 剩餘請求數
+	Reset     time.Duration // 額度完全恢復或下一次允許的時間
+}
+
+// 限流算法接口
+type limiter interface {
+	take(key string, now time.Time) RateResult
+	// 清理已恢復的key
+	clear(now time.Time)
+	// 數量超過max時刪除任意key，被刪除的key重新獲得額度
+	trim(max int)
+	size() int
+}
+
+// 創建限流算法，rate為window秒内允許的請求數，burst只對令牌桶有效，0為rate
+func newLimiter(algorithm string, rate int, window time.Duration, burst int) (limiter, error) {
+	if rate <= 0 || window <= 0 {
+		return nil, errors.New("限流rate和window必須大於0")
+	}
+	switch algorithm {
+	case LimitToken, "":
+		if burst <= 0 {
+			burst = rate
+		}
+		return &tokenLimiter{rate: rate, window: window, burst: burst, buckets: newShardMap[*tokenBucket]()}, nil
+	case LimitFixed:
+		return &fixedLimiter{rate: rate, window: window, windows: newShardMap[*fixedWindow]()}, nil
+	case LimitSliding:
+		return &slidingLimiter{rate: rate, window: window, logs: newShardMap[[]time.Time]()}, nil
+	}
+	return nil, errors.New("不支持的限流算法:" + algorithm)
+}
+
+// 令牌桶
+type tokenLimiter struct {
+	rate    int
+	window  time.Duration
+	burst   int
+	buckets *shardMap[*tokenBucket]
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 每個令牌的補充時間
+func (this *tokenLimiter) interval() time.Duration {
+	return this.window / time.Duration(this.rate)
+}
+
+func (this *tokenLimiter) take(key string, now time.Time) RateResult {
+	res := RateResult{Limit: this.burst}
+	this.buckets.Do(key, func(m map[string]*tokenBucket) {
+		b, ok := m[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(this.burst), last: now}
+			m[key] = b
+		}
+		// 按經過的時間補充令牌
+		b.tokens += float64(now.Sub(b.last)) / float64(this.interval())
+		if b.tokens > float64(this.burst) {
+			b.tokens = float64(this.burst)
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			res.Allowed = true
+		}
+		res.Remaining = int(b.tokens)
+		if res.Allowed {
+			res.Reset = time.Duration((float64(this.burst) - b.tokens) * float64(this.interval()))
+		} else {
+			res.Reset = time.Duration((1 - b.tokens) * float64(this.interval()))
+		}
+	})
+	return res
+}
+
+func (this *tokenLimiter) clear(now time.Time) {
+	full := time.Duration(this.burst) * this.interval()
+	this.buckets.DeleteIf(func(key string, b *tokenBucket) bool {
+		return now.Sub(b.last) >= full
+	})
+}
+
+func (this *tokenLimiter) trim(max int) {
+	this.buckets.Trim(max, nil)
+}
+
+func (this *tokenLimiter) size() int {
+	return this.buckets.Len()
+}
+
+// 固定窗口
+type fixedLimiter struct {
+	rate    int
+	window  time.Duration
+	windows *shardMap[*fixedWindow]
+}
+
+type fixedWindow struct {
+	count int
+	start time.Time
+}
+
+func (this *fixedLimiter) take(key string, now time.Time) RateResult {
+	res := RateResult{Limit: this.rate}
+	this.windows.Do(key, func(m map[string]*fixedWindow) {
+		w, ok := m[key]
+		if !ok || now.Sub(w.start) >= this.window {
+			w = &fixedWindow{start: now.Truncate(this.window)}
+			m[key] = w
+		}
+		res.Reset = w.start.Add(this.window).Sub(now)
+		if w.count < this.rate {
+			w.count++
+			res.Allowed = true
+		}
+		res.Remaining = this.rate - w.count
+	})
+	return res
+}
+
+func (this *fixedLimiter) clear(now time.Time) {
+	this.windows.DeleteIf(func(key string, w *fixedWindow) bool {
+		return now.Sub(w.start) >= this.window
+	})
+}
+
+func (this *fixedLimiter) trim(max int) {
+	this.windows.Trim(max, nil)
+}
+
+func (this *fixedLimiter) size() int {
+	return this.windows.Len()
+}
+
+// 滑動窗口日志
+type slidingLimiter struct {
+	rate   int
+	window time.Duration
+	logs   *shardMap[[]time.Time]
+}
+
+func (this *slidingLimiter) take(key string, now time.Time) RateResult {
+	res := RateResult{Limit: this.rate}
+	this.logs.Do(key, func(m map[string][]time.Time) {
+		// 去掉窗口外的記錄
+		log := m[key]
+		start := 0
+		for start < len(log) && now.Sub(log[start]) >= this.window {
+			start++
+		}
+		log = log[start:]
+		if len(log) < this.rate {
+			log = append(log, now)
+			res.Allowed = true
+		}
+		m[key] = log
+		res.Remaining = this.rate - len(log)
+		// 最早一條記錄過期後恢復一次額度
+		res.Reset = log[0].Add(this.window).Sub(now)
+	})
+	return res
+}
+
+func (this *slidingLimiter) clear(now time.Time) {
+	this.logs.DeleteIf(func(key string, log []time.Time) bool {
+		return len(log) == 0 || now.Sub(log[len(log)-1]) >= this.window
+	})
+}
+
+func (this *slidingLimiter) trim(max int) {
+	this.logs.Trim(max, nil)
+}
+
+func (this *slidingLimiter) size() int {
+	return this.logs.Len()
+}
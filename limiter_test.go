@@ -0,0 +1,93 @@
+package goweber
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{LimitToken, LimitFixed, LimitSliding} {
+		t.Run(algorithm, func(t *testing.T) {
+			l, err := newLimiter(algorithm, 5, time.Second, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Unix(1000, 0)
+			for i := 0; i < 5; i++ {
+				res := l.take("1.2.3.4", now)
+				if !res.Allowed || res.Remaining != 4-i {
+					t.Fatalf("request %d: %+v", i, res)
+				}
+			}
+			res := l.take("1.2.3.4", now)
+			if res.Allowed || res.Reset <= 0 {
+				t.Fatalf("over limit: %+v", res)
+			}
+			// 其他key不受影響
+			if !l.take("5.6.7.8", now).Allowed {
+				t.Fatal("other key limited")
+			}
+			// 一個窗口後恢復
+			if !l.take("1.2.3.4", now.Add(time.Second)).Allowed {
+				t.Fatal("not restored after window")
+			}
+			l.clear(now.Add(time.Hour))
+			if l.size() != 0 {
+				t.Fatalf("size %d after clear", l.size())
+			}
+		})
+	}
+}
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	l, _ := newLimiter(LimitSliding, 2, time.Second, 0)
+	now := time.Unix(1000, 0)
+	l.take("k", now)
+	l.take("k", now.Add(900*time.Millisecond))
+	// 固定窗口此時已重置，滑動窗口仍計算900ms的請求
+	if !l.take("k", now.Add(1100*time.Millisecond)).Allowed {
+		t.Fatal("first request should have expired")
+	}
+	if l.take("k", now.Add(1200*time.Millisecond)).Allowed {
+		t.Fatal("sliding window allowed burst")
+	}
+}
+
+func TestLimiterTokenBurst(t *testing.T) {
+	l, _ := newLimiter(LimitToken, 1, time.Second, 3)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if !l.take("k", now).Allowed {
+			t.Fatalf("burst request %d limited", i)
+		}
+	}
+	if l.take("k", now).Allowed {
+		t.Fatal("burst exceeded")
+	}
+	if !l.take("k", now.Add(time.Second)).Allowed {
+		t.Fatal("token not refilled")
+	}
+}
+
+func TestRaterAllow(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	if !rater.Allow("1.2.3.4") {
+		t.Fatal("disabled limiter blocked")
+	}
+	rater.Limit = 1
+	rater.Algorithm = LimitSliding
+	rater.Rate = 2
+	rater.Window = 60
+	if err := rater.SetLimiter(); err != nil {
+		t.Fatal(err)
+	}
+	rater.Allow("1.2.3.4")
+	rater.Allow("1.2.3.4")
+	if rater.Allow("1.2.3.4") {
+		t.Fatal("limit not enforced")
+	}
+	if rater.IsBlocked("1.2.3.4") {
+		t.Fatal("request limit must not ban")
+	}
+}
@@ -0,0 +1,191 @@
+// * 限流策略
+// * 命名的限流策略，可掛載到路由或路由組，例如/login每分鐘5次，/search每秒30次，靜態路由不掛載即不限流
+// * 每個策略有獨立的算法、額度、封禁時間和key（IP、登錄用戶、API Key、自定義頭部或函數）
+// * 用戶、API Key和頭部取自請求，未經驗證，客戶端每次換一個值即可得到新的額度，因此同時按IP計數，IP或key任一超限即拒絕
+// * 需只按身份限流時使用KeyFunc，由KeyFunc返回已驗證的身份
+package goweber
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限流key類型
+const (
+	KeyIp     = "ip"     // 客戶端IP
+	KeyUser   = "user"   // 登錄用戶，Basic認證用戶名或Bearer令牌，沒有時使用IP
+	KeyApiKey = "apikey" // X-Api-Key頭部，沒有時使用IP
+)
+
+// RatePolicy 限流策略
+// RatePolicy is a named rate limit that can be attached to routes or groups
+type RatePolicy struct {
+	sync.Mutex
+	Name      string // 策略名稱
+	Algorithm string // 限流算法 token,fixed,sliding
+	Rate      int    // 窗口内允許請求數
+	Window    int    // 窗口秒
+	Burst     int    // 令牌桶容量，0為Rate
+	Block     int    // 超限後封禁秒數，0為只拒絕超限請求
+	Key       string // key類型 ip,user,apikey,header:頭部名稱
+	IpMax     int    // 最大監控key數量
+	// 自定義key函數，設置後忽略Key，需返回已驗證的身份，只按該身份計數
+	// Custom key function, overrides Key when set, it must return a verified identity which is counted alone
+	KeyFunc   func(r *http.Request) string
+	limiter   limiter
+	blocks    map[string]time.Time
+	trim      throttle // 超過IpMax時的清理頻率
+	blockTrim throttle // 封禁超過IpMax時的清理頻率
+}
+
+// NewRatePolicy 創建限流策略，默認按IP
+// NewRatePolicy creates a policy keyed by client IP
+func NewRatePolicy(name string, algorithm string, rate int, window int) *RatePolicy {
+	return &RatePolicy{
+		Name:      name,
+		Algorithm: algorithm,
+		Rate:      rate,
+		Window:    window,
+		Key:       KeyIp,
+		IpMax:     10000,
+	}
+}
+
+// init 創建限流算法，Apper.Policy注冊時調用
+func (this *RatePolicy) init() error {
+	if this.Name == "" {
+		return errors.New("限流策略名稱不能為空")
+	}
+	switch {
+	case this.Key == KeyIp, this.Key == KeyUser, this.Key == KeyApiKey, this.Key == "":
+	case strings.HasPrefix(this.Key, "header:") && len(this.Key) > len("header:"):
+	default:
+		return errors.New("限流策略" + this.Name + "不支持的key:" + this.Key)
+	}
+	l, err := newLimiter(this.Algorithm, this.Rate, time.Duration(this.Window)*time.Second, this.Burst)
+	if err != nil {
+		return errors.New("限流策略" + this.Name + ":" + err.Error())
+	}
+	this.Lock()
+	defer this.Unlock()
+	this.limiter = l
+	this.blocks = make(map[string]time.Time)
+	return nil
+}
+
+// KeyOf 獲得請求的限流key，ip為客戶端IP，無法從請求中取得用戶或API Key時使用ip
+// KeyOf returns the limit key of the request, falling back to ip when no user or API key is present
+func (this *RatePolicy) KeyOf(r *http.Request, ip string) string {
+	var key string
+	switch {
+	case this.KeyFunc != nil:
+		key = this.KeyFunc(r)
+	case this.Key == KeyUser:
+		key = requestUser(r)
+	case this.Key == KeyApiKey:
+		key = r.Header.Get("X-Api-Key")
+	case strings.HasPrefix(this.Key, "header:"):
+		key = r.Header.Get(strings.TrimPrefix(this.Key, "header:"))
+	}
+	if key == "" {
+		return "ip:" + ip
+	}
+	return "key:" + key
+}
+
+// Keys 獲得請求需計數的全部key，未經驗證的用戶、API Key和頭部同時按ip計數，KeyFunc的身份只按身份計數
+// Keys returns every key the request counts against, unverified users, API keys and headers are counted by ip too, KeyFunc identities alone
+func (this *RatePolicy) Keys(r *http.Request, ip string) []string {
+	key := this.KeyOf(r, ip)
+	if this.KeyFunc != nil || strings.HasPrefix(key, "ip:") {
+		return []string{key}
+	}
+	return []string{"ip:" + ip, key}
+}
+
+// TakeRequest 對請求的全部key限流，按順序檢查，任一超限即拒絕，之後的key不再計數
+// TakeRequest checks every key of the request in order, rejecting at the first exceeded key without counting the rest
+func (this *RatePolicy) TakeRequest(r *http.Request, ip string) RateResult {
+	var res RateResult
+	for _, key := range this.Keys(r, ip) {
+		if res = this.Take(key); !res.Allowed {
+			break
+		}
+	}
+	return res
+}
+
+// 從Authorization中取得用戶，Basic為用戶名，Bearer為令牌
+func requestUser(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	scheme, value, ok := strings.Cut(auth, " ")
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		raw, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return ""
+		}
+		user, _, _ := strings.Cut(string(raw), ":")
+		return user
+	case "bearer":
+		return value
+	}
+	return ""
+}
+
+// Take 對key限流，封禁中直接拒絕，超限且Block>0時封禁key
+// Take checks key against the policy, blocked keys are rejected and exceeding keys are blocked when Block > 0
+func (this *RatePolicy) Take(key string) RateResult {
+	now := time.Now()
+	this.Lock()
+	if until, ok := this.blocks[key]; ok {
+		if now.Before(until) {
+			this.Unlock()
+			return RateResult{Limit: this.Rate, Reset: until.Sub(now)}
+		}
+		delete(this.blocks, key)
+	}
+	l := this.limiter
+	this.Unlock()
+	if l == nil {
+		return RateResult{Allowed: true}
+	}
+	// 超過監控上綫，限頻清理已恢復額度的key，仍超過時刪除任意key
+	if l.size() >= this.IpMax {
+		if this.trim.allow(now, time.Second) {
+			l.clear(now)
+		}
+		l.trim(this.IpMax - 1) // 為新key留出位置
+	}
+	res := l.take(key, now)
+	if !res.Allowed && this.Block > 0 {
+		this.Lock()
+		// 超過監控上綫，限頻清理過期封禁，仍超過時丟棄任意一條，保證不超過上限
+		if len(this.blocks) >= this.IpMax {
+			if this.blockTrim.allow(now, time.Second) {
+				for k, until := range this.blocks {
+					if now.After(until) {
+						delete(this.blocks, k)
+					}
+				}
+			}
+			for k := range this.blocks {
+				if len(this.blocks) < this.IpMax {
+					break
+				}
+				delete(this.blocks, k)
+			}
+		}
+		this.blocks[key] = now.Add(time.Duration(this.Block) * time.Second)
+		this.Unlock()
+		res.Reset = time.Duration(this.Block) * time.Second
+	}
+	return res
+}
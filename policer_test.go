@@ -0,0 +1,165 @@
+package goweber
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// 創建測試用Apper，丟棄日志消息
+func newTestApp(t *testing.T) *Apper {
+	app := New()
+	go func() {
+		for range app.msg {
+		}
+	}()
+	t.Cleanup(app.Close)
+	return app
+}
+
+func serve(app *Apper, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+func TestRatePolicyRoute(t *testing.T) {
+	app := newTestApp(t)
+	p := NewRatePolicy("test-login", LimitSliding, 2, 60)
+	p.Block = 60
+	if err := app.Policy(p); err != nil {
+		t.Fatal(err)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	api := app.Group("/api", app.RateLimit("test-login"))
+	api.Post("/login", ok)
+	app.Get("/static", ok)
+
+	for i := 0; i < 2; i++ {
+		if w := serve(app, "POST", "/api/login", nil); w.Code != 200 {
+			t.Fatalf("request %d: %d", i, w.Code)
+		}
+	}
+	if w := serve(app, "POST", "/api/login", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over limit: %d", w.Code)
+	}
+	// 未掛載策略的路由不限流
+	for i := 0; i < 5; i++ {
+		if w := serve(app, "GET", "/static", nil); w.Code != 200 {
+			t.Fatalf("static %d: %d", i, w.Code)
+		}
+	}
+}
+
+func TestRatePolicyKey(t *testing.T) {
+	p := NewRatePolicy("k", LimitFixed, 1, 60)
+	p.Key = KeyUser
+	r := httptest.NewRequest("GET", "/", nil)
+	if key := p.KeyOf(r, "1.2.3.4"); key != "ip:1.2.3.4" {
+		t.Fatalf("anonymous key %s", key)
+	}
+	r.SetBasicAuth("alice", "secret")
+	if key := p.KeyOf(r, "1.2.3.4"); key != "key:alice" {
+		t.Fatalf("user key %s", key)
+	}
+	p.Key = "header:X-Tenant"
+	r.Header.Set("X-Tenant", "acme")
+	if key := p.KeyOf(r, "1.2.3.4"); key != "key:acme" {
+		t.Fatalf("header key %s", key)
+	}
+	if keys := p.Keys(r, "1.2.3.4"); len(keys) != 2 || keys[0] != "ip:1.2.3.4" || keys[1] != "key:acme" {
+		t.Fatalf("header keys %v", keys)
+	}
+	p.KeyFunc = func(r *http.Request) string { return "verified" }
+	if keys := p.Keys(r, "1.2.3.4"); len(keys) != 1 || keys[0] != "key:verified" {
+		t.Fatalf("KeyFunc keys %v", keys)
+	}
+	p.Key = "bogus"
+	if err := p.init(); err == nil {
+		t.Fatal("bogus key accepted")
+	}
+}
+
+func TestRatePolicyRotatingKey(t *testing.T) {
+	app := newTestApp(t)
+	p := NewRatePolicy("test-rotate", LimitSliding, 5, 60)
+	p.Key = KeyApiKey
+	if err := app.Policy(p); err != nil {
+		t.Fatal(err)
+	}
+	app.Post("/login", func(w http.ResponseWriter, r *http.Request) {}, app.RateLimit("test-rotate"))
+	// 每次換一個API Key，同一IP仍然被限流
+	for i := 0; i < 10; i++ {
+		w := serve(app, "POST", "/login", http.Header{"X-Api-Key": {strconv.Itoa(i)}})
+		if i < 5 && w.Code != 200 || i >= 5 && w.Code != http.StatusTooManyRequests {
+			t.Fatalf("request %d: %d", i, w.Code)
+		}
+	}
+	// 超限後不再為新的key創建計數
+	if n := p.limiter.size(); n != 6 {
+		t.Fatalf("limiter keys %d", n)
+	}
+	// 同一個key從不同IP請求，按key限流
+	p2 := NewRatePolicy("test-key", LimitSliding, 2, 60)
+	p2.Key = KeyApiKey
+	if err := app.Policy(p2); err != nil {
+		t.Fatal(err)
+	}
+	app.Post("/api", func(w http.ResponseWriter, r *http.Request) {}, app.RateLimit("test-key"))
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/api", nil)
+		r.RemoteAddr = "198.51.100." + strconv.Itoa(i+1) + ":1234"
+		r.Header.Set("X-Api-Key", "shared")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if i < 2 && w.Code != 200 || i == 2 && w.Code != http.StatusTooManyRequests {
+			t.Fatalf("shared key %d: %d", i, w.Code)
+		}
+	}
+}
+
+func TestRatePolicyBlocksCap(t *testing.T) {
+	p := NewRatePolicy("cap", LimitFixed, 1, 60)
+	p.Block = 60
+	p.IpMax = 3
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := "ip:" + strconv.Itoa(i)
+		p.Take(key)
+		p.Take(key)
+	}
+	if len(p.blocks) > p.IpMax {
+		t.Fatalf("blocks %d", len(p.blocks))
+	}
+}
+
+func TestRateHeaders(t *testing.T) {
+	app := newTestApp(t)
+	app.rateBody = `{"code":429}`
+	if err := app.Policy(NewRatePolicy("test-headers", LimitSliding, 1, 3600)); err != nil {
+		t.Fatal(err)
+	}
+	app.Get("/search", func(w http.ResponseWriter, r *http.Request) {}, app.RateLimit("test-headers"))
+
+	w := serve(app, "GET", "/search", nil)
+	if w.Code != 200 || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("allowed: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Retry-After") != "" {
+		t.Fatal("Retry-After on allowed request")
+	}
+	w = serve(app, "GET", "/search", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Reset") == "" {
+		t.Fatalf("denied: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Content-Type") != "application/json; charset=utf-8" || w.Body.String() != "{\"code\":429}\n" {
+		t.Fatalf("body %q %s", w.Body.String(), w.Header().Get("Content-Type"))
+	}
+}
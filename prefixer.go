@@ -0,0 +1,113 @@
+// * 地址聚合
+// * IPv6客戶端通常擁有整個/64，輪換地址即可繞過按單個地址的封禁，并把監控列表撐到上限
+// * 計數和封禁按前綴聚合，例如IPv6按/64，IPv4可選按/24
+// * 升級：同一升級前綴内被封禁的key達到Escalate個時，封禁整個升級前綴
+package goweber
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Prefixer 地址聚合參數，需在使用前設置，nil為按單個地址
+// Prefixer aggregates addresses into prefixes for counting and blocking, nil means per address
+type Prefixer struct {
+	IPv4         int // IPv4計數和封禁前綴長度，32為按單個地址
+	IPv6         int // IPv6計數和封禁前綴長度，128為按單個地址
+	Escalate     int // 升級前綴内被封禁的key數量達到該值時封禁整個前綴，0為不升級
+	EscalateIPv4 int // IPv4升級前綴長度
+	EscalateIPv6 int // IPv6升級前綴長度
+}
+
+func NewPrefixer() *Prefixer {
+	return &Prefixer{
+		IPv4:         32,
+		IPv6:         64,
+		EscalateIPv4: 24,
+		EscalateIPv6: 48,
+	}
+}
+
+// Key 計數和封禁使用的key，聚合時為前綴，如2001:db8::/64
+// Key returns the counting and blocking key, a prefix such as 2001:db8::/64 when aggregated
+func (this *Prefixer) Key(ip string) string {
+	if this == nil {
+		return ip
+	}
+	addr, ok := NormalizeIP(ip)
+	if !ok {
+		return ip
+	}
+	if addr.Is4() {
+		return prefixKey(addr, this.IPv4)
+	}
+	return prefixKey(addr, this.IPv6)
+}
+
+// 升級前綴，未開啓或不比聚合前綴更大時返回false
+func (this *Prefixer) escalation(ip string) (string, bool) {
+	if this == nil || this.Escalate <= 0 {
+		return "", false
+	}
+	addr, ok := NormalizeIP(ip)
+	if !ok {
+		return "", false
+	}
+	bits, esc := this.IPv6, this.EscalateIPv6
+	if addr.Is4() {
+		bits, esc = this.IPv4, this.EscalateIPv4
+	}
+	if esc <= 0 || esc >= min(bits, addr.BitLen()) {
+		return "", false
+	}
+	return prefixKey(addr, esc), true
+}
+
+// 封禁ip所在的key，升級前綴内封禁數量達到Escalate時同時封禁升級前綴，返回升級前綴及其封禁數量
+// escKey為升級計數的key前綴，計數在until後過期
+func (this *Prefixer) block(store Store, blockKey, escKey, ip string, until time.Time) (string, int64, error) {
+	if err := store.SetBlock(blockKey+this.Key(ip), until); err != nil {
+		return "", 0, err
+	}
+	prefix, ok := this.escalation(ip)
+	if !ok {
+		return "", 0, nil
+	}
+	n, err := store.Incr(escKey+prefix, time.Until(until))
+	if err != nil || n < int64(this.Escalate) {
+		return "", n, err
+	}
+	return prefix, n, store.SetBlock(blockKey+prefix, until)
+}
+
+// 查詢ip所在的key及升級前綴是否封禁，返回最晚的解封時間
+func (this *Prefixer) blockedUntil(store Store, blockKey, ip string) (time.Time, bool, error) {
+	e, ok, err := store.Get(blockKey + this.Key(ip))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if prefix, esc := this.escalation(ip); esc {
+		pe, pok, err := store.Get(blockKey + prefix)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if pok && (!ok || pe.Expire.After(e.Expire)) {
+			e, ok = pe, true
+		}
+	}
+	return e.Expire, ok, nil
+}
+
+func (this *Prefixer) String() string {
+	return fmt.Sprintf("&{IPv4:%d IPv6:%d Escalate:%d EscalateIPv4:%d EscalateIPv6:%d}",
+		this.IPv4, this.IPv6, this.Escalate, this.EscalateIPv4, this.EscalateIPv6)
+}
+
+// 前綴長度不小於地址長度時為單個地址
+func prefixKey(addr netip.Addr, bits int) string {
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
@@ -0,0 +1,116 @@
+package goweber
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestPrefixerKey(t *testing.T) {
+	p := NewPrefixer()
+	tests := []struct {
+		ip, want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"bogus", "bogus"},
+	}
+	for _, tt := range tests {
+		if got := p.Key(tt.ip); got != tt.want {
+			t.Errorf("%s: got %s want %s", tt.ip, got, tt.want)
+		}
+	}
+	p.IPv4 = 24
+	if got := p.Key("1.2.3.4"); got != "1.2.3.0/24" {
+		t.Fatalf("ipv4 /24: %s", got)
+	}
+	var none *Prefixer
+	if none.Key("2001:db8::1") != "2001:db8::1" {
+		t.Fatal("nil prefixer aggregated")
+	}
+}
+
+// 輪換/64内的地址不能繞過封禁
+func TestPrefixerRotate(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.Second = 60
+	rater.ErrMax = 3
+	rater.Prefixer = NewPrefixer()
+	for i := 1; i <= 3; i++ {
+		rater.SetStatus("2001:db8::" + strconv.Itoa(i))
+	}
+	if !rater.IsBlocked("2001:db8::ffff") {
+		t.Fatal("/64 not blocked")
+	}
+	if rater.IsBlocked("2001:db8:0:1::1") {
+		t.Fatal("neighbouring /64 blocked")
+	}
+	if _, ok := rater.Blocked()["2001:db8::/64"]; !ok {
+		t.Fatalf("blocked %v", rater.Blocked())
+	}
+}
+
+// 同一/24内兩個地址被封禁後升級封禁整個/24
+func TestPrefixerEscalate(t *testing.T) {
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.MaxErr = 1
+	bruter.Prefixer = NewPrefixer()
+	bruter.Prefixer.Escalate = 2
+	bruter.SetStatus("192.0.2.1")
+	if !bruter.IsBlocked("192.0.2.1") || bruter.IsBlocked("192.0.2.9") {
+		t.Fatal("escalated after one ban")
+	}
+	bruter.SetStatus("192.0.2.2")
+	if !bruter.IsBlocked("192.0.2.9") {
+		t.Fatal("/24 not blocked after two bans")
+	}
+	if bruter.IsBlocked("192.0.3.1") {
+		t.Fatal("neighbouring /24 blocked")
+	}
+	// 升級前綴不比聚合前綴大時不升級
+	bruter.Prefixer.IPv4 = 16
+	if _, ok := bruter.Prefixer.escalation("198.51.100.1"); ok {
+		t.Fatal("escalation narrower than aggregation")
+	}
+}
+
+func TestPrefixerLimit(t *testing.T) {
+	app := newTestApp(t)
+	app.Prefixer = NewPrefixer()
+	app.rate.Prefixer = app.Prefixer
+	app.rate.Limit = 1
+	app.rate.Algorithm = LimitFixed
+	app.rate.Rate = 1
+	app.rate.Window = 60
+	app.rate.IpMax = 100
+	if err := app.rate.SetLimiter(); err != nil {
+		t.Fatal(err)
+	}
+	// 同一/64的地址共用請求限流額度
+	if !app.rate.Take("2001:db8::1").Allowed || app.rate.Take("2001:db8::2").Allowed {
+		t.Fatal("request limit not aggregated")
+	}
+	if !app.rate.Take("2001:db8:0:1::1").Allowed {
+		t.Fatal("other prefix limited")
+	}
+	// 限流策略同樣按前綴計數
+	app.rate.Limit = 0
+	app.rate.SetLimiter()
+	p := NewRatePolicy("test-prefix", LimitFixed, 1, 60)
+	if err := app.Policy(p); err != nil {
+		t.Fatal(err)
+	}
+	app.Iper.Trusted, _ = ParseCIDRs("192.0.2.1")
+	app.Get("/api", func(w http.ResponseWriter, r *http.Request) {}, app.RateLimit("test-prefix"))
+	from := func(ip string) http.Header { return http.Header{"X-Forwarded-For": {ip}} }
+	if w := serve(app, "GET", "/api", from("2001:db8:0:2::1")); w.Code != 200 {
+		t.Fatalf("first: %d", w.Code)
+	}
+	if w := serve(app, "GET", "/api", from("2001:db8:0:2::2")); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("same /64: %d", w.Code)
+	}
+}
@@ -0,0 +1,317 @@
+// * PROXY協議
+// * 位於TCP負載均衡後面時，解析HAProxy PROXY協議v1/v2頭部，把真實客戶端地址作爲RemoteAddr
+// * 只解析可信來源的連接，其他來源的連接原樣返回
+package goweber
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2頭部簽名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Proxyer PROXY協議配置
+// Proxyer parses PROXY protocol headers from trusted load balancers
+type Proxyer struct {
+	Trusted []*net.IPNet // 可信來源，只有這些地址發來的連接才解析頭部
+	Timeout int          // 讀取頭部超時，單位秒
+}
+
+// NewProxyer 創建PROXY協議解析器，默認5秒超時
+// NewProxyer creates a PROXY protocol parser with a 5 second header timeout
+func NewProxyer(trusted []*net.IPNet) *Proxyer {
+	return &Proxyer{
+		Trusted: trusted,
+		Timeout: 5,
+	}
+}
+
+// IsTrusted 判斷地址是否可信
+// IsTrusted reports whether the address belongs to a trusted network
+func (this *Proxyer) IsTrusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range this.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener 包裝監聽器，頭部在獨立協程中解析，不阻塞Accept
+// Listener wraps ln, headers are parsed in separate goroutines so a slow client never blocks Accept
+func (this *Proxyer) Listener(ln net.Listener) net.Listener {
+	return &proxyListener{
+		Listener: ln,
+		proxy:    this,
+		ready:    make(chan net.Conn),
+		errc:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// Conn 解析連接的PROXY頭部，不可信來源原樣返回
+// Conn parses the PROXY header of c, connections from untrusted sources are returned unchanged
+func (this *Proxyer) Conn(c net.Conn) (net.Conn, error) {
+	if !this.IsTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	if this.Timeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(time.Duration(this.Timeout) * time.Second)); err != nil {
+			return nil, err
+		}
+	}
+	br := bufio.NewReader(c)
+	src, dst, err := readProxyHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: br, remote: src, local: dst}, nil
+}
+
+// 讀取頭部，LOCAL命令或UNKNOWN協議時返回nil地址
+func readProxyHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	prefix, err := br.Peek(6)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(prefix) == "PROXY " {
+		return readProxyV1(br)
+	}
+	return nil, nil, errors.New("proxy協議頭部缺失")
+}
+
+// v1文本格式：PROXY TCP4 源地址 目標地址 源端口 目標端口\r\n，最長107字節
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, nil, errors.New("proxy v1頭部過長")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy v1頭部格式錯誤")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("proxy v1頭部格式錯誤")
+	}
+	src, err := proxyTCPAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := proxyTCPAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// 解析v1地址和端口
+func proxyTCPAddr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, errors.New("proxy v1地址錯誤:" + host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, errors.New("proxy v1端口錯誤:" + port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// v2二進制格式：12字節簽名，版本/命令，協議族，2字節長度，地址及TLV
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, errors.New("proxy v2版本錯誤")
+	}
+	cmd := head[12] & 0x0f
+	fam := head[13]
+	size := int(binary.BigEndian.Uint16(head[14:16]))
+	body := make([]byte, size)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	switch cmd {
+	case 0x0: // LOCAL，負載均衡自身的連接，如健康檢查
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errors.New("proxy v2命令錯誤")
+	}
+	switch fam >> 4 {
+	case 0x1: // IPv4
+		if len(body) < 12 {
+			return nil, nil, errors.New("proxy v2地址長度錯誤")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		return src, dst, nil
+	case 0x2: // IPv6
+		if len(body) < 36 {
+			return nil, nil, errors.New("proxy v2地址長度錯誤")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		return src, dst, nil
+	}
+	// UNSPEC及UNIX地址保持原連接地址
+	return nil, nil, nil
+}
+
+// 已解析頭部的連接
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (this *proxyConn) Read(b []byte) (int, error) {
+	return this.r.Read(b)
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	if this.remote != nil {
+		return this.remote
+	}
+	return this.Conn.RemoteAddr()
+}
+
+func (this *proxyConn) LocalAddr() net.Addr {
+	if this.local != nil {
+		return this.local
+	}
+	return this.Conn.LocalAddr()
+}
+
+// 解析PROXY頭部的監聽器
+type proxyListener struct {
+	net.Listener
+	proxy     *Proxyer
+	once      sync.Once
+	closeOnce sync.Once
+	ready     chan net.Conn
+	errc      chan error
+	done      chan struct{}
+}
+
+func (this *proxyListener) Accept() (net.Conn, error) {
+	this.once.Do(func() { go this.serve() })
+	select {
+	case c := <-this.ready:
+		return c, nil
+	case err := <-this.errc:
+		return nil, err
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// 接收原始連接，每個連接在獨立協程中解析頭部
+func (this *proxyListener) serve() {
+	for {
+		c, err := this.Listener.Accept()
+		if err != nil {
+			select {
+			case this.errc <- err:
+			case <-this.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			pc, err := this.proxy.Conn(c)
+			if err != nil {
+				c.Close()
+				return
+			}
+			select {
+			case this.ready <- pc:
+			case <-this.done:
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (this *proxyListener) Close() error {
+	this.closeOnce.Do(func() { close(this.done) })
+	return this.Listener.Close()
+}
+
+// ParseCIDRs 解析逗號分隔的CIDR列表，單個IP視爲/32或/128
+// ParseCIDRs parses a comma separated CIDR list, a bare IP is treated as /32 or /128
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range splitList(s) {
+		n, err := ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ParseCIDR 解析CIDR，單個IP視爲/32或/128
+// ParseCIDR parses a CIDR, a bare IP is treated as /32 or /128
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("IP格式錯誤:" + s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.New("CIDR格式錯誤:" + s)
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package goweber
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// 通過包裝後的監聽器發送頭部和數據，返回服務端看到的連接和數據
+func proxyAccept(t *testing.T, trusted string, header []byte) (net.Conn, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nets, err := ParseCIDRs(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pln := NewProxyer(nets).Listener(ln)
+	t.Cleanup(func() { pln.Close() })
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	go client.Write(append(header, []byte("hello")...))
+
+	c, err := pln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return c, string(buf)
+}
+
+func TestProxyV1(t *testing.T) {
+	c, data := proxyAccept(t, "127.0.0.1", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"))
+	if c.RemoteAddr().String() != "203.0.113.7:51234" {
+		t.Fatalf("remote addr %s", c.RemoteAddr())
+	}
+	if data != "hello" {
+		t.Fatalf("data %q", data)
+	}
+}
+
+func TestProxyV1Ipv6(t *testing.T) {
+	c, _ := proxyAccept(t, "127.0.0.0/8", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 80\r\n"))
+	if c.RemoteAddr().String() != "[2001:db8::1]:4000" {
+		t.Fatalf("remote addr %s", c.RemoteAddr())
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	var header bytes.Buffer
+	header.Write(proxyV2Sig)
+	header.WriteByte(0x21) // v2 PROXY
+	header.WriteByte(0x11) // TCP over IPv4
+	binary.Write(&header, binary.BigEndian, uint16(12))
+	header.Write(net.ParseIP("198.51.100.9").To4())
+	header.Write(net.ParseIP("10.0.0.1").To4())
+	binary.Write(&header, binary.BigEndian, uint16(40000))
+	binary.Write(&header, binary.BigEndian, uint16(443))
+
+	c, data := proxyAccept(t, "127.0.0.1", header.Bytes())
+	if c.RemoteAddr().String() != "198.51.100.9:40000" {
+		t.Fatalf("remote addr %s", c.RemoteAddr())
+	}
+	if data != "hello" {
+		t.Fatalf("data %q", data)
+	}
+}
+
+func TestProxyV2Local(t *testing.T) {
+	header := append([]byte{}, proxyV2Sig...)
+	header = append(header, 0x20, 0x00, 0x00, 0x00)
+	c, _ := proxyAccept(t, "127.0.0.1", header)
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if host != "127.0.0.1" {
+		t.Fatalf("remote addr %s", c.RemoteAddr())
+	}
+}
+
+func TestProxyUntrusted(t *testing.T) {
+	// 不可信來源不解析頭部，頭部作爲普通數據
+	c, data := proxyAccept(t, "10.0.0.0/8", []byte{})
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if host != "127.0.0.1" || data != "hello" {
+		t.Fatalf("remote addr %s data %q", c.RemoteAddr(), data)
+	}
+}
+
+func TestProxyMalformed(t *testing.T) {
+	_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 bad 10.0.0.1 1 2\r\n")))
+	if err == nil {
+		t.Fatal("malformed header accepted")
+	}
+	_, _, err = readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n")))
+	if err == nil {
+		t.Fatal("missing header accepted")
+	}
+}
@@ -1,110 +1,269 @@
 // 限流器
 // 基於IP的限流器，如果1秒内出現100請求都是404，則封禁IP 5分鐘
+// 另可對所有請求限流（Limit），與404封禁相互獨立，算法見limiter.go
+// 監控和封禁列表保存在Store中，默認為進程内存儲，後台協程定時清理過期數據，Close後停止
 package goweber
 
 import (
-	"time"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
+
 // 限流器數據結構
+// 參數需在使用前設置，運行中開關使用SetStart
 type Rater struct {
-    sync.RWMutex // 添加读写锁
-	Start int // 是否開啓，0為關閉，1為開啓
-    Second int // 監控秒
-	BlockMinute int // 封禁分鐘
-    ErrMax int // 最大請求錯誤次數
-	IpMax int // 最大監控IP數量
-	ErrorIps map[string]*IpData // 監控IP
-	BlockIps map[string]time.Time // 封禁IP
+	sync.RWMutex                 // 保護limiter
+	Second       int             // 監控秒
+	BlockMinute  int             // 封禁分鐘
+	ErrMax       int             // 最大請求錯誤次數
+	IpMax        int             // 最大監控IP數量
+	Limit        int             // 是否開啓請求限流，0為關閉，1為開啓
+	Algorithm    string          // 限流算法 token,fixed,sliding
+	Rate         int             // 窗口内允許請求數
+	Window       int             // 限流窗口秒
+	Burst        int             // 令牌桶容量，0為Rate
+	Store        Store           // 監控和封禁列表存儲，多實例時共用
+	Prefixer     *Prefixer       // 地址聚合，nil為按單個地址
+	OnError      func(err error) // 存儲出錯時調用，出錯時不封禁
+	start        atomic.Int32    // 是否開啓，0為關閉，1為開啓
+	limiter      limiter
+	trim         throttle // 超過IpMax時的清理頻率
+	storeTrim    throttle // Store中計數超過IpMax時的清理頻率
+	stop         chan struct{}
+	closeOnce    sync.Once
+	banHooks     // OnBlock,OnUnblock
 }
+
 // 監控IP數據結構
 type IpData struct {
-	Count int
+	Count    int
 	LastTime time.Time
 }
 
-// 實例化
+// 實例化，啓動後台清理協程
 func NewRater() *Rater {
 	// 初始化，1秒出現10個404則封禁IP 5分鐘
-	return &Rater{
-		Start:0,
-		Second: 1,
-		ErrMax: 10,
-		IpMax: 10000,
+	rater := &Rater{
+		Second:      1,
+		ErrMax:      10,
+		IpMax:       10000,
 		BlockMinute: 5,
-		ErrorIps: make(map[string]*IpData),
-		BlockIps: make(map[string]time.Time),
+		Algorithm:   LimitToken,
+		Rate:        20,
+		Window:      1,
+		Store:       NewMemoryStore(),
+		banHooks:    newBanHooks(),
+		stop:        make(chan struct{}),
+	}
+	go rater.expire(time.Minute)
+	return rater
+}
+
+// 開啓或關閉404封禁，0為關閉，1為開啓
+func (this *Rater) SetStart(start int) {
+	this.start.Store(int32(start))
+}
+
+// 是否開啓404封禁
+func (this *Rater) Started() bool {
+	return this.start.Load() == 1
+}
+
+// 按Algorithm、Rate、Window、Burst創建請求限流，修改參數後需重新調用，Limit為0時關閉
+func (this *Rater) SetLimiter() error {
+	var l limiter
+	if this.Limit == 1 {
+		var err error
+		l, err = newLimiter(this.Algorithm, this.Rate, time.Duration(this.Window)*time.Second, this.Burst)
+		if err != nil {
+			return err
+		}
 	}
+	this.Lock()
+	this.limiter = l
+	this.Unlock()
+	return nil
+}
+
+// 請求限流判斷，key一般為IP，未開啓時總是允許
+func (this *Rater) Allow(key string) bool {
+	return this.Take(key).Allowed
+}
+
+// 請求限流判斷，返回剩餘額度等信息，IP按Prefixer聚合計數
+func (this *Rater) Take(key string) RateResult {
+	this.RLock()
+	l := this.limiter
+	this.RUnlock()
+	if l == nil {
+		return RateResult{Allowed: true}
+	}
+	now := time.Now()
+	// 超過監控上綫，清理已恢復額度的key，仍超過時刪除任意key
+	if l.size() >= this.IpMax {
+		if this.trim.allow(now, time.Second) {
+			l.clear(now)
+		}
+		l.trim(this.IpMax - 1) // 為新key留出位置
+	}
+	return l.take(this.Prefixer.Key(key), now)
 }
 
 // 判斷IP監控狀態
 func (this *Rater) SetStatus(ip string) {
-	if this.Start==0{
-        return
+	if !this.Started() {
+		return
 	}
-    this.Lock()
-	defer this.Unlock()
 	// 超過監控上綫，清理
-    if len(this.ErrorIps)>this.IpMax{
-        this.ClearErrorIps()
-    }
-    if ipData,exists:=this.ErrorIps[ip];exists{
-        if time.Since(ipData.LastTime)>time.Duration(this.Second)*time.Second{
-            ipData.Count=1
-			ipData.LastTime=time.Now()
-        }else{
-            ipData.Count++
-			if ipData.Count>=this.ErrMax{
-			    this.BlockIps[ip]=time.Now() // 加入鎖定列表
-				delete(this.ErrorIps,ip) //從監控列表刪除
-			}
-		}
-    }else{
-        this.ErrorIps[ip]=&IpData{Count:1,LastTime:time.Now()} // 加入監控列表
+	trimStore(this.Store, this.IpMax, storeRateErr, &this.storeTrim)
+	key := this.Prefixer.Key(ip)
+	count, err := this.Store.Incr(storeRateErr+key, time.Duration(this.Second)*time.Second) // 加入監控列表
+	if err != nil {
+		this.fail(err)
+		return
+	}
+	if count < int64(this.ErrMax) {
+		return
+	}
+	// 加入鎖定列表
+	until := time.Now().Add(time.Duration(this.BlockMinute) * time.Minute)
+	if !this.block(ip, BanEvent{Source: "rate", Reason: "too many not found", Count: count, Limit: this.ErrMax, Until: until}) {
+		return
+	}
+	if err := this.Store.Delete(storeRateErr + key); err != nil { //從監控列表刪除
+		this.fail(err)
 	}
 }
 
+// 把IP所在的key加入鎖定列表直到ev.Until，ev為封禁事件的來源、原因等，存儲出錯時返回false
+func (this *Rater) block(ip string, ev BanEvent) bool {
+	escalated, n, err := this.Prefixer.block(this.Store, storeRateBlock, storeRateEsc, ip, ev.Until)
+	if err != nil {
+		this.fail(err)
+		return false
+	}
+	ev.Key = this.Prefixer.Key(ip)
+	this.blocked(ev)
+	if escalated != "" {
+		this.blocked(BanEvent{Source: ev.Source, Key: escalated, Reason: "escalate", Count: n, Limit: this.Prefixer.Escalate, Until: ev.Until})
+	}
+	return true
+}
+
 // 判斷是否鎖定中
 func (this *Rater) IsBlocked(ip string) bool {
-	if this.Start==0 {
-        return false
-	}
-    this.RLock()
-	defer this.RUnlock()
-    // * 測試使用
-    // fmt.Println(this.ErrorIps)
-    // fmt.Println(this.BlockIps)
-	// 超過監控上綫，清理
-    if len(this.ErrorIps)>this.IpMax{
-        this.ClearBlockIps()
-    }
-    if _,exists:=this.BlockIps[ip];exists{
-        if time.Since(this.BlockIps[ip])>=time.Duration(this.BlockMinute) * time.Minute {
-            delete(this.BlockIps,ip) // 解鎖
-            return false
-        }
-        return true
-    }
-    return false
+	if !this.Started() {
+		return false
+	}
+	return this.BlockReset(ip) > 0
+}
+
+// 封禁剩餘時間，未封禁時為0
+func (this *Rater) BlockReset(ip string) time.Duration {
+	until, exists, err := this.Prefixer.blockedUntil(this.Store, storeRateBlock, ip)
+	if err != nil {
+		this.fail(err)
+		return 0
+	}
+	if !exists {
+		return 0
+	}
+	return max(time.Until(until), 0)
+}
+
+// 手動解封IP或聚合前綴，調用OnUnblock
+func (this *Rater) Unblock(key, reason string) error {
+	if err := this.Store.Delete(storeRateBlock + key); err != nil {
+		return err
+	}
+	this.unblocked("rate", key, reason, time.Time{})
+	return nil
+}
+
+// 封禁列表快照，IP或聚合前綴對應解封時間
+func (this *Rater) Blocked() map[string]time.Time {
+	res := make(map[string]time.Time)
+	entries, err := this.Store.List(storeRateBlock)
+	if err != nil {
+		this.fail(err)
+	}
+	for _, e := range entries {
+		res[strings.TrimPrefix(e.Key, storeRateBlock)] = e.Expire
+	}
+	return res
+}
+
+// 監控列表快照
+func (this *Rater) Monitored() map[string]IpData {
+	res := make(map[string]IpData)
+	entries, err := this.Store.List(storeRateErr)
+	if err != nil {
+		this.fail(err)
+	}
+	for _, e := range entries {
+		res[strings.TrimPrefix(e.Key, storeRateErr)] = IpData{
+			Count:    int(e.Value),
+			LastTime: e.Expire.Add(-time.Duration(this.Second) * time.Second),
+		}
+	}
+	return res
+}
+
+// * 清理監控列表和鎖定列表的過期條目，一次掃描，Store自行過期時無需清理
+func (this *Rater) Clear() {
+	clearStore(this.Store)
 }
 
 // * 監控列表清理
+// Deprecated: 與ClearBlockIps清理同一個Store，使用Clear
 func (this *Rater) ClearErrorIps() {
-    this.Lock()
-    defer this.Unlock()
-    for ip,ipData:=range this.ErrorIps{
-        if time.Since(ipData.LastTime)>=time.Duration(this.Second) * time.Second {
-            delete(this.ErrorIps,ip)
-        }
-    }
+	this.Clear()
 }
+
 // * 鎖定列表清理
+// Deprecated: 與ClearErrorIps清理同一個Store，使用Clear
 func (this *Rater) ClearBlockIps() {
-    this.Lock()
-    defer this.Unlock()
-    for ip,_:=range this.BlockIps{
-        if time.Since(this.BlockIps[ip])>=time.Duration(this.BlockMinute)*time.Minute{
-            delete(this.BlockIps,ip)
-        }
-    }
-}
\ No newline at end of file
+	this.Clear()
+}
+
+// 存儲出錯
+func (this *Rater) fail(err error) {
+	if this.OnError != nil {
+		this.OnError(err)
+	}
+}
+
+// * 後台定時清理過期數據
+func (this *Rater) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case now := <-ticker.C:
+			this.Clear()
+			this.expireBlocks("rate", now)
+			this.RLock()
+			l := this.limiter
+			this.RUnlock()
+			if l != nil {
+				l.clear(now)
+			}
+		}
+	}
+}
+
+// 停止後台清理，Store需另行關閉
+func (this *Rater) Close() {
+	this.closeOnce.Do(func() { close(this.stop) })
+}
+
+func (this *Rater) String() string {
+	return fmt.Sprintf("&{Start:%d Second:%d BlockMinute:%d ErrMax:%d IpMax:%d Limit:%d Algorithm:%s Rate:%d Window:%d Burst:%d Store:%T}",
+		this.start.Load(), this.Second, this.BlockMinute, this.ErrMax, this.IpMax, this.Limit, this.Algorithm, this.Rate, this.Window, this.Burst,
+		this.Store)
+}
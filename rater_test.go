@@ -0,0 +1,200 @@
+package goweber
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRaterBlock(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.ErrMax = 3
+	for i := 0; i < 2; i++ {
+		rater.SetStatus("1.2.3.4")
+	}
+	if rater.IsBlocked("1.2.3.4") {
+		t.Fatal("blocked before errmax")
+	}
+	rater.SetStatus("1.2.3.4")
+	if !rater.IsBlocked("1.2.3.4") {
+		t.Fatal("not blocked at errmax")
+	}
+	if reset := rater.BlockReset("1.2.3.4"); reset <= 4*time.Minute || reset > 5*time.Minute {
+		t.Fatalf("reset %s", reset)
+	}
+	if _, ok := rater.Blocked()["1.2.3.4"]; !ok {
+		t.Fatal("missing from snapshot")
+	}
+	rater.SetStart(0)
+	if rater.IsBlocked("1.2.3.4") {
+		t.Fatal("blocked while disabled")
+	}
+}
+
+func TestRaterExpire(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.Store.SetBlock(storeRateBlock+"1.2.3.4", time.Now().Add(-time.Second))
+	if rater.IsBlocked("1.2.3.4") {
+		t.Fatal("expired block still active")
+	}
+	if rater.Store.(*MemoryStore).Len() != 0 {
+		t.Fatal("expired block not removed")
+	}
+}
+
+// 并發讀寫同一批IP，需使用go test -race運行
+func TestRaterConcurrent(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.Second = 60
+	rater.ErrMax = 5
+	rater.IpMax = 100
+	rater.Limit = 1
+	if err := rater.SetLimiter(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				ip := "10.0." + strconv.Itoa(g) + "." + strconv.Itoa(i%300)
+				rater.SetStatus(ip)
+				rater.IsBlocked(ip)
+				rater.Take(ip)
+				if i%500 == 0 {
+					rater.ClearErrorIps()
+					rater.ClearBlockIps()
+					rater.Blocked()
+					rater.Monitored()
+					rater.SetStart(1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(rater.Blocked()) == 0 {
+		t.Fatal("nothing blocked")
+	}
+}
+
+func BenchmarkRaterSetStatus(b *testing.B) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.IpMax = 200000
+	ips := benchIps(100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rater.SetStatus(ips[i%len(ips)])
+			i++
+		}
+	})
+}
+
+func TestRaterIpMax(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.Second = 60
+	rater.ErrMax = 3
+	rater.IpMax = 100
+	rater.Limit = 1
+	if err := rater.SetLimiter(); err != nil {
+		t.Fatal(err)
+	}
+	store := rater.Store.(*MemoryStore)
+	// 封禁的IP不被刪除
+	rater.SetStatus("192.0.2.1")
+	rater.SetStatus("192.0.2.1")
+	rater.SetStatus("192.0.2.1")
+	for _, ip := range benchIps(1000) {
+		rater.SetStatus(ip)
+		rater.Take(ip)
+		if store.prefixLen(storeRateErr) > rater.IpMax {
+			t.Fatalf("store %d counters", store.prefixLen(storeRateErr))
+		}
+		if rater.limiter.size() > rater.IpMax {
+			t.Fatalf("limiter %d keys", rater.limiter.size())
+		}
+	}
+	if !rater.IsBlocked("192.0.2.1") {
+		t.Fatal("block evicted")
+	}
+}
+
+func TestRaterIpMaxBlocks(t *testing.T) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.ErrMax = 3
+	rater.IpMax = 100
+	// 封禁條目達到IpMax時不佔用計數名額，404計數仍然生效
+	for _, ip := range benchIps(200) {
+		rater.Store.SetBlock(storeRateBlock+ip, time.Now().Add(time.Hour))
+	}
+	for i := 0; i < 3; i++ {
+		rater.SetStatus("192.0.2.1")
+	}
+	if !rater.IsBlocked("192.0.2.1") {
+		t.Fatal("not blocked after 3 errors")
+	}
+	if n := rater.Store.(*MemoryStore).prefixLen(storeRateBlock); n != 201 {
+		t.Fatalf("blocks = %d", n)
+	}
+}
+
+func BenchmarkRaterIsBlocked(b *testing.B) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	ips := benchIps(100000)
+	for i, ip := range ips {
+		if i%2 == 0 {
+			rater.Store.SetBlock(storeRateBlock+ip, time.Now().Add(time.Hour))
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rater.IsBlocked(ips[i%len(ips)])
+			i++
+		}
+	})
+}
+
+func BenchmarkRaterTake(b *testing.B) {
+	rater := NewRater()
+	defer rater.Close()
+	rater.Limit = 1
+	rater.IpMax = 200000
+	rater.SetLimiter()
+	ips := benchIps(100000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rater.Take(ips[i%len(ips)])
+			i++
+		}
+	})
+}
+
+// n個不同IP
+func benchIps(n int) []string {
+	ips := make([]string, n)
+	for i := range ips {
+		ips[i] = "10." + strconv.Itoa(i>>16&255) + "." + strconv.Itoa(i>>8&255) + "." + strconv.Itoa(i&255)
+	}
+	return ips
+}
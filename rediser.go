@@ -0,0 +1,346 @@
+// * Redis協議存儲
+// * 實現Store接口，使用RESP協議直接與Redis(或兼容服務)通信，多實例共用計數和封禁列表
+// * 連接池復用連接，網絡錯誤時丟棄連接，下次請求重新建立
+package goweber
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rediser Redis存儲，參數需在使用前設置
+// Rediser is a Store backed by a Redis-protocol server
+type Rediser struct {
+	Addr     string // 地址 host:port
+	Password string // 密碼，為空時不認證
+	DB       int    // 數據庫編號
+	Prefix   string // key前綴，多個應用共用Redis時區分
+	Timeout  int    // 連接和讀寫超時，秒，0為不限制
+	MaxIdle  int    // 最大空閑連接數
+	mu       sync.Mutex
+	idle     []*redisConn
+	closed   bool
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// RedisError Redis返回的錯誤回復
+// RedisError is an error reply from the server
+type RedisError string
+
+func (this RedisError) Error() string {
+	return "redis: " + string(this)
+}
+
+func NewRediser(addr string) *Rediser {
+	return &Rediser{
+		Addr:    addr,
+		Prefix:  "goweber:",
+		Timeout: 3,
+		MaxIdle: 16,
+	}
+}
+
+func (this *Rediser) Incr(key string, ttl time.Duration) (int64, error) {
+	// 事務中先創建帶過期時間的key，再計數，避免計數器永不過期
+	res, err := this.do(
+		[]string{"MULTI"},
+		[]string{"SET", this.Prefix + key, "0", "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10), "NX"},
+		[]string{"INCR", this.Prefix + key},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		return 0, err
+	}
+	exec, ok := res[3].([]any)
+	if !ok || len(exec) != 2 {
+		return 0, fmt.Errorf("redis: unexpected EXEC reply %v", res[3])
+	}
+	n, ok := exec[1].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %v", exec[1])
+	}
+	return n, nil
+}
+
+func (this *Rediser) Get(key string) (StoreEntry, bool, error) {
+	entries, err := this.entries([]string{key})
+	if err != nil || len(entries) == 0 {
+		return StoreEntry{}, false, err
+	}
+	return entries[0], true, nil
+}
+
+func (this *Rediser) SetBlock(key string, until time.Time) error {
+	if until.IsZero() {
+		_, err := this.do([]string{"SET", this.Prefix + key, "1"})
+		return err
+	}
+	ms := time.Until(until).Milliseconds()
+	if ms <= 0 {
+		return this.Delete(key)
+	}
+	_, err := this.do([]string{"SET", this.Prefix + key, "1", "PX", strconv.FormatInt(ms, 10)})
+	return err
+}
+
+func (this *Rediser) Delete(key string) error {
+	_, err := this.do([]string{"DEL", this.Prefix + key})
+	return err
+}
+
+func (this *Rediser) List(prefix string) ([]StoreEntry, error) {
+	var keys []string
+	cursor := "0"
+	match := redisGlobEscape(this.Prefix+prefix) + "*"
+	for {
+		res, err := this.do([]string{"SCAN", cursor, "MATCH", match, "COUNT", "100"})
+		if err != nil {
+			return nil, err
+		}
+		reply, ok := res[0].([]any)
+		if !ok || len(reply) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", res[0])
+		}
+		cursor, _ = reply[0].(string)
+		batch, _ := reply[1].([]any)
+		for _, k := range batch {
+			if k, ok := k.(string); ok {
+				keys = append(keys, strings.TrimPrefix(k, this.Prefix))
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	return this.entries(keys)
+}
+
+// 批量讀取值和剩餘時間，跳過已不存在的key
+func (this *Rediser) entries(keys []string) ([]StoreEntry, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	cmds := make([][]string, 0, len(keys)*2)
+	for _, key := range keys {
+		cmds = append(cmds, []string{"GET", this.Prefix + key}, []string{"PTTL", this.Prefix + key})
+	}
+	res, err := this.do(cmds...)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entries := make([]StoreEntry, 0, len(keys))
+	for i, key := range keys {
+		val, ok := res[i*2].(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: %s is not a counter", key)
+		}
+		e := StoreEntry{Key: key, Value: n}
+		if ttl, ok := res[i*2+1].(int64); ok && ttl >= 0 {
+			e.Expire = now.Add(time.Duration(ttl) * time.Millisecond)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Close 關閉所有空閑連接，之後的請求返回錯誤
+func (this *Rediser) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.closed = true
+	for _, c := range this.idle {
+		c.Close()
+	}
+	this.idle = nil
+	return nil
+}
+
+// 管道發送多條命令并按順序讀取回復，任一回復為錯誤時返回該錯誤
+func (this *Rediser) do(cmds ...[]string) ([]any, error) {
+	c, err := this.get()
+	if err != nil {
+		return nil, err
+	}
+	this.deadline(c)
+	res, err := c.pipeline(cmds)
+	var rerr RedisError
+	if err != nil && !errors.As(err, &rerr) {
+		// 網絡或協議錯誤，連接狀態未知，丟棄
+		c.Close()
+		return nil, err
+	}
+	this.put(c)
+	return res, err
+}
+
+func (this *Rediser) get() (*redisConn, error) {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil, errors.New("redis: store closed")
+	}
+	if n := len(this.idle); n > 0 {
+		c := this.idle[n-1]
+		this.idle = this.idle[:n-1]
+		this.mu.Unlock()
+		return c, nil
+	}
+	this.mu.Unlock()
+	return this.dial()
+}
+
+func (this *Rediser) put(c *redisConn) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed || len(this.idle) >= this.MaxIdle {
+		c.Close()
+		return
+	}
+	this.idle = append(this.idle, c)
+}
+
+func (this *Rediser) dial() (*redisConn, error) {
+	timeout := time.Duration(this.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", this.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	var cmds [][]string
+	if this.Password != "" {
+		cmds = append(cmds, []string{"AUTH", this.Password})
+	}
+	if this.DB != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(this.DB)})
+	}
+	if len(cmds) > 0 {
+		this.deadline(c)
+		if _, err := c.pipeline(cmds); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// 設置讀寫超時，Timeout<=0時清除超時，空閑連接可能保留上次的設置
+func (this *Rediser) deadline(c *redisConn) {
+	if this.Timeout <= 0 {
+		c.SetDeadline(time.Time{})
+		return
+	}
+	c.SetDeadline(time.Now().Add(time.Duration(this.Timeout) * time.Second))
+}
+
+// 寫入所有命令後依次讀取回復
+func (this *redisConn) pipeline(cmds [][]string) ([]any, error) {
+	var b []byte
+	for _, cmd := range cmds {
+		b = append(b, '*')
+		b = strconv.AppendInt(b, int64(len(cmd)), 10)
+		b = append(b, '\r', '\n')
+		for _, arg := range cmd {
+			b = append(b, '$')
+			b = strconv.AppendInt(b, int64(len(arg)), 10)
+			b = append(b, '\r', '\n')
+			b = append(b, arg...)
+			b = append(b, '\r', '\n')
+		}
+	}
+	if _, err := this.Write(b); err != nil {
+		return nil, err
+	}
+	res := make([]any, len(cmds))
+	var first error
+	for i := range cmds {
+		v, err := readResp(this.r)
+		var rerr RedisError
+		if err != nil && !errors.As(err, &rerr) {
+			return nil, err
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		res[i] = v
+	}
+	return res, first
+}
+
+// 讀取一個RESP回復：簡單字符串和批量字符串為string，整數為int64，數組為[]any，空值為nil
+// 數組中的錯誤回復作為RedisError值返回
+func readResp(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			v, err := readResp(r)
+			var rerr RedisError
+			if errors.As(err, &rerr) {
+				v, err = rerr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// 轉義SCAN MATCH中的通配符
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
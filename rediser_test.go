@@ -0,0 +1,294 @@
+package goweber
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 進程内RESP服務，只實現Rediser用到的命令
+type respServer struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	data map[string]respValue
+}
+
+type respValue struct {
+	val    string
+	expire time.Time
+}
+
+func newRespServer(t *testing.T) *respServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{ln: ln, data: make(map[string]respValue)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (this *respServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	var queue [][]string
+	multi := false
+	for {
+		v, err := readResp(r)
+		if err != nil {
+			return
+		}
+		arr, _ := v.([]any)
+		cmd := make([]string, len(arr))
+		for i, a := range arr {
+			cmd[i], _ = a.(string)
+		}
+		var reply string
+		switch {
+		case len(cmd) == 0:
+			reply = "-ERR empty command\r\n"
+		case strings.ToUpper(cmd[0]) == "MULTI":
+			multi, queue = true, nil
+			reply = "+OK\r\n"
+		case strings.ToUpper(cmd[0]) == "EXEC":
+			reply = "*" + strconv.Itoa(len(queue)) + "\r\n"
+			this.mu.Lock()
+			for _, q := range queue {
+				reply += this.exec(q)
+			}
+			this.mu.Unlock()
+			multi, queue = false, nil
+		case multi:
+			queue = append(queue, cmd)
+			reply = "+QUEUED\r\n"
+		default:
+			this.mu.Lock()
+			reply = this.exec(cmd)
+			this.mu.Unlock()
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (this *respServer) exec(cmd []string) string {
+	now := time.Now()
+	get := func(key string) (respValue, bool) {
+		v, ok := this.data[key]
+		if ok && !v.expire.IsZero() && !now.Before(v.expire) {
+			delete(this.data, key)
+			return v, false
+		}
+		return v, ok
+	}
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+	switch strings.ToUpper(cmd[0]) {
+	case "AUTH", "SELECT", "PING":
+		return "+OK\r\n"
+	case "SET":
+		v := respValue{val: cmd[2]}
+		nx := false
+		for i := 3; i < len(cmd); i++ {
+			switch strings.ToUpper(cmd[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(cmd[i+1])
+				v.expire = now.Add(time.Duration(ms) * time.Millisecond)
+				i++
+			}
+		}
+		if _, ok := get(cmd[1]); ok && nx {
+			return "$-1\r\n"
+		}
+		this.data[cmd[1]] = v
+		return "+OK\r\n"
+	case "GET":
+		v, ok := get(cmd[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v.val)
+	case "INCR":
+		v, _ := get(cmd[1])
+		n, err := strconv.ParseInt(v.val, 10, 64)
+		if v.val != "" && err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		v.val = strconv.FormatInt(n+1, 10)
+		this.data[cmd[1]] = v
+		return ":" + v.val + "\r\n"
+	case "PTTL":
+		v, ok := get(cmd[1])
+		switch {
+		case !ok:
+			return ":-2\r\n"
+		case v.expire.IsZero():
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(v.expire.Sub(now).Milliseconds(), 10) + "\r\n"
+	case "DEL":
+		_, ok := get(cmd[1])
+		delete(this.data, cmd[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SCAN":
+		var keys []string
+		for key := range this.data {
+			if ok, _ := path.Match(cmd[3], key); ok {
+				if _, ok := get(key); ok {
+					keys = append(keys, bulk(key))
+				}
+			}
+		}
+		return "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", cmd[0])
+}
+
+func TestRediserStore(t *testing.T) {
+	srv := newRespServer(t)
+	store := NewRediser(srv.ln.Addr().String())
+	store.Password = "secret"
+	store.DB = 1
+	defer store.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := store.Incr("rate:err:1.2.3.4", time.Minute)
+		if err != nil || n != i {
+			t.Fatalf("incr %d: %d %v", i, n, err)
+		}
+	}
+	e, ok, err := store.Get("rate:err:1.2.3.4")
+	if err != nil || !ok || e.Value != 3 || time.Until(e.Expire) <= 50*time.Second {
+		t.Fatalf("get %+v %v %v", e, ok, err)
+	}
+	srv.mu.Lock()
+	_, ok = srv.data["goweber:rate:err:1.2.3.4"]
+	srv.data["goweber:bad"] = respValue{val: "x"}
+	srv.mu.Unlock()
+	if !ok {
+		t.Fatal("key prefix not applied")
+	}
+	if err := store.SetBlock("rate:block:1.2.3.4", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetBlock("rate:block:[::1]", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List("rate:block:")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("list %v %v", list, err)
+	}
+	if err := store.Delete("rate:block:1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get("rate:block:1.2.3.4"); ok {
+		t.Fatal("deleted key still present")
+	}
+	// 計數過期後重新開始
+	store.Incr("brute:err:5.6.7.8", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if n, _ := store.Incr("brute:err:5.6.7.8", time.Minute); n != 1 {
+		t.Fatalf("expired counter continued at %d", n)
+	}
+	// 錯誤回復不影響連接復用
+	if _, err := store.Incr("bad", time.Minute); err == nil {
+		t.Fatal("non-integer incr accepted")
+	}
+	if _, _, err := store.Get("rate:err:1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 兩個實例共用計數，錯誤分散到兩個實例仍然封禁
+func TestRediserShared(t *testing.T) {
+	srv := newRespServer(t)
+	raters := make([]*Rater, 2)
+	for i := range raters {
+		store := NewRediser(srv.ln.Addr().String())
+		defer store.Close()
+		raters[i] = NewRater()
+		defer raters[i].Close()
+		raters[i].Store = store
+		raters[i].SetStart(1)
+		raters[i].Second = 60
+		raters[i].ErrMax = 4
+	}
+	for i := 0; i < 4; i++ {
+		raters[i%2].SetStatus("1.2.3.4")
+	}
+	for i, rater := range raters {
+		if !rater.IsBlocked("1.2.3.4") {
+			t.Fatalf("instance %d not blocked", i)
+		}
+	}
+	if _, ok := raters[1].Blocked()["1.2.3.4"]; !ok {
+		t.Fatal("missing from shared block list")
+	}
+}
+
+// 存儲不可用時不封禁并報告錯誤
+func TestRediserDown(t *testing.T) {
+	srv := newRespServer(t)
+	store := NewRediser(srv.ln.Addr().String())
+	store.Timeout = 1
+	defer store.Close()
+	srv.ln.Close()
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.Store = store
+	var errs []error
+	bruter.OnError = func(err error) { errs = append(errs, err) }
+	bruter.MaxErr = 1
+	bruter.SetStatus("1.2.3.4")
+	if bruter.IsBlocked("1.2.3.4") || len(errs) != 2 {
+		t.Fatalf("blocked with store down, errors %v", errs)
+	}
+}
+
+func TestRediserNoTimeout(t *testing.T) {
+	srv := newRespServer(t)
+	store := NewRediser(srv.ln.Addr().String())
+	store.Password = "secret"
+	store.Timeout = 0
+	defer store.Close()
+	// 0為不限制，而不是立即超時
+	for i := int64(1); i <= 2; i++ {
+		if n, err := store.Incr("rate:err:1.2.3.4", time.Minute); err != nil || n != i {
+			t.Fatalf("incr %d: %d %v", i, n, err)
+		}
+	}
+}
+
+func TestRediserPermanent(t *testing.T) {
+	srv := newRespServer(t)
+	store := NewRediser(srv.ln.Addr().String())
+	defer store.Close()
+	// 零值為永久封禁，而不是刪除
+	if err := store.SetBlock(storeAccessBan+"192.0.2.0/24", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	e, ok, err := store.Get(storeAccessBan + "192.0.2.0/24")
+	if err != nil || !ok || !e.Expire.IsZero() {
+		t.Fatalf("get %+v %v %v", e, ok, err)
+	}
+}
@@ -0,0 +1,150 @@
+// * 響應記錄
+// * ServeHTTP把每個請求的ResponseWriter包裝為Responser並放入請求上下文
+// * 中間件只能拿到*http.Request，通過GetResponser可以設置響應頭、讀取響應狀態、注冊響應結束後的回調
+package goweber
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type responserKey struct{}
+
+// Responser 記錄響應狀態的ResponseWriter
+// Responser is a ResponseWriter recording the response status
+type Responser struct {
+	http.ResponseWriter
+	Status int   // 響應狀態碼，未寫入時為0
+	Size   int64 // 已寫入字節數
+	after  []func(status int)
+	brute  *bruteSignal // Bruter.Protect的處理結果
+}
+
+// 包裝ResponseWriter并放入請求上下文
+func newResponser(w http.ResponseWriter, r *http.Request) (*Responser, *http.Request) {
+	rw := &Responser{ResponseWriter: w}
+	return rw, r.WithContext(context.WithValue(r.Context(), responserKey{}, rw))
+}
+
+// GetResponser 獲得請求的Responser，請求不是由Apper處理時返回nil
+// GetResponser returns the request's Responser, nil when the request was not dispatched by Apper
+func GetResponser(r *http.Request) *Responser {
+	rw, _ := r.Context().Value(responserKey{}).(*Responser)
+	return rw
+}
+
+func (this *Responser) WriteHeader(code int) {
+	if this.Status == 0 {
+		this.Status = code
+	}
+	this.ResponseWriter.WriteHeader(code)
+}
+
+func (this *Responser) Write(b []byte) (int, error) {
+	if this.Status == 0 {
+		this.Status = http.StatusOK
+	}
+	n, err := this.ResponseWriter.Write(b)
+	this.Size += int64(n)
+	return n, err
+}
+
+// Flush 支持流式響應
+// Flush supports streaming responses
+func (this *Responser) Flush() {
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		if this.Status == 0 {
+			this.Status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack 接管連接，如WebSocket，被包裝的ResponseWriter不支持時返回http.ErrNotSupported
+// Hijack takes over the connection, e.g. for WebSocket, returning http.ErrNotSupported when the wrapped writer cannot
+func (this *Responser) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(this.ResponseWriter).Hijack()
+	if err == nil && this.Status == 0 {
+		this.Status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// ReadFrom 支持io.Copy使用sendfile等優化
+// ReadFrom lets io.Copy use optimisations such as sendfile
+func (this *Responser) ReadFrom(src io.Reader) (int64, error) {
+	if this.Status == 0 {
+		this.Status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := this.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(this.ResponseWriter, src)
+	}
+	this.Size += n
+	return n, err
+}
+
+// Unwrap 供http.ResponseController使用
+// Unwrap is used by http.ResponseController
+func (this *Responser) Unwrap() http.ResponseWriter {
+	return this.ResponseWriter
+}
+
+// After 注冊響應結束後的回調，按注冊的相反順序執行，中間件拒絕請求時也會執行
+// After registers a callback run when the response is finished, in reverse order, also when middleware rejects the request
+func (this *Responser) After(f func(status int)) {
+	this.after = append(this.after, f)
+}
+
+// 執行響應結束回調，一個回調panic時其他回調仍執行，全部執行後再拋出第一個panic
+func (this *Responser) finish() {
+	status := this.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	var first any
+	for i := len(this.after) - 1; i >= 0; i-- {
+		if err := callAfter(this.after[i], status); err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		panic(first)
+	}
+}
+
+// 執行一個回調，返回其panic
+func callAfter(f func(status int), status int) (err any) {
+	defer func() { err = recover() }()
+	f(status)
+	return nil
+}
+
+// SetRateHeaders 設置RateLimit-Limit、RateLimit-Remaining、RateLimit-Reset頭部，多個限流同時生效時保留剩餘最少的
+// 不允許時同時設置Retry-After
+// SetRateHeaders sets the IETF draft RateLimit headers keeping the most restrictive limit, and Retry-After when denied
+func SetRateHeaders(h http.Header, res RateResult) {
+	if res.Limit <= 0 {
+		return
+	}
+	if old := h.Get("RateLimit-Remaining"); old != "" {
+		if remaining, err := strconv.Atoi(old); err == nil && remaining < res.Remaining {
+			return
+		}
+	}
+	reset := strconv.Itoa(int((res.Reset + time.Second - 1) / time.Second))
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", reset)
+	if !res.Allowed {
+		h.Set("Retry-After", reset)
+	}
+}
@@ -0,0 +1,70 @@
+package goweber
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponserHijack(t *testing.T) {
+	app := newTestApp(t)
+	status := make(chan int, 1)
+	app.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
+		GetResponser(r).After(func(s int) { status <- s })
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Error("Responser未實現http.Hijacker")
+			return
+		}
+		conn, buf, err := hj.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\nhello")
+		buf.Flush()
+	})
+	server := httptest.NewServer(app)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	if s := <-status; s != http.StatusSwitchingProtocols {
+		t.Fatalf("After status %d", s)
+	}
+
+	// 不支持Hijack時返回錯誤而不是panic
+	rw, _ := newResponser(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if _, _, err := rw.Hijack(); err == nil {
+		t.Fatal("recorder不支持Hijack")
+	}
+}
+
+func TestResponserReadFrom(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw, _ := newResponser(rec, httptest.NewRequest("GET", "/", nil))
+	var w http.ResponseWriter = rw
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		t.Fatal("Responser未實現io.ReaderFrom")
+	}
+	n, err := rf.ReadFrom(strings.NewReader("hello"))
+	if err != nil || n != 5 || rw.Size != 5 || rw.Status != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("got %d %v size %d status %d body %q", n, err, rw.Size, rw.Status, rec.Body.String())
+	}
+}
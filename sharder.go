@@ -0,0 +1,137 @@
+// * 分片map
+// * 按key的哈希分到64個分片，每個分片獨立加鎖，大量不同IP并發訪問時減少鎖競爭
+package goweber
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const shardCount = 64
+
+// 分片map
+type shardMap[V any] struct {
+	shards [shardCount]shard[V]
+	size   atomic.Int64
+}
+
+type shard[V any] struct {
+	sync.Mutex
+	m map[string]V
+}
+
+func newShardMap[V any]() *shardMap[V] {
+	sm := &shardMap[V]{}
+	for i := range sm.shards {
+		sm.shards[i].m = make(map[string]V)
+	}
+	return sm
+}
+
+// FNV-1a哈希選擇分片
+func (this *shardMap[V]) shard(key string) *shard[V] {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &this.shards[h%shardCount]
+}
+
+// Do 鎖定key所在分片，f中可讀寫該分片的map
+func (this *shardMap[V]) Do(key string, f func(m map[string]V)) {
+	s := this.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	before := len(s.m)
+	f(s.m)
+	this.size.Add(int64(len(s.m) - before))
+}
+
+// Get 讀取key
+func (this *shardMap[V]) Get(key string) (V, bool) {
+	s := this.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.m[key]
+	return v, ok
+}
+
+// Set 寫入key
+func (this *shardMap[V]) Set(key string, v V) {
+	this.Do(key, func(m map[string]V) { m[key] = v })
+}
+
+// Delete 刪除key
+func (this *shardMap[V]) Delete(key string) {
+	this.Do(key, func(m map[string]V) { delete(m, key) })
+}
+
+// Each 依次鎖定每個分片，f中可讀寫該分片的map
+func (this *shardMap[V]) Each(f func(m map[string]V)) {
+	for i := range this.shards {
+		s := &this.shards[i]
+		s.Lock()
+		before := len(s.m)
+		f(s.m)
+		this.size.Add(int64(len(s.m) - before))
+		s.Unlock()
+	}
+}
+
+// DeleteIf 刪除滿足條件的key
+func (this *shardMap[V]) DeleteIf(f func(key string, v V) bool) {
+	this.Each(func(m map[string]V) {
+		for k, v := range m {
+			if f(k, v) {
+				delete(m, k)
+			}
+		}
+	})
+}
+
+// Trim 數量超過max時刪除滿足條件的key，直到不超過max的9/10，f為nil時可刪除任意key
+// 留出餘量，避免每次寫入都全量掃描
+func (this *shardMap[V]) Trim(max int, f func(key string, v V) bool) {
+	if this.Len() <= max {
+		return
+	}
+	target := max - max/10
+	for i := range this.shards {
+		if this.Len() <= target {
+			return
+		}
+		s := &this.shards[i]
+		s.Lock()
+		before := len(s.m)
+		for k, v := range s.m {
+			if this.Len()-(before-len(s.m)) <= target {
+				break
+			}
+			if f == nil || f(k, v) {
+				delete(s.m, k)
+			}
+		}
+		this.size.Add(int64(len(s.m) - before))
+		s.Unlock()
+	}
+}
+
+// Len key數量
+func (this *shardMap[V]) Len() int {
+	return int(this.size.Load())
+}
+
+// 限制清理頻率，數量超過上限時每個周期最多全量清理一次
+type throttle struct {
+	last atomic.Int64
+}
+
+func (this *throttle) allow(now time.Time, interval time.Duration) bool {
+	last := this.last.Load()
+	if now.UnixNano()-last < int64(interval) {
+		return false
+	}
+	return this.last.CompareAndSwap(last, now.UnixNano())
+}
@@ -0,0 +1,126 @@
+// * 請求大小限制
+// * ServeHTTP在中間件之前檢查請求頭數量和大小、查詢字符串長度，並用http.MaxBytesReader限制請求體
+// * 聲明的Content-Length超過限制時直接返回413，分塊傳輸時讀取超過限制返回*http.MaxBytesError，app.Error響應413
+// * multipart請求按分隔符計數，部分數超過MaxParts時讀取返回ErrTooManyParts
+// * 單個路徑可用app.BodyLimit設置更大或更小的請求體限制，如文件上傳
+package goweber
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrTooManyParts multipart部分數超過限制
+// ErrTooManyParts is returned when reading a multipart body with too many parts
+var ErrTooManyParts = NewHttpError(http.StatusRequestEntityTooLarge, "Too Many Parts")
+
+// Sizer 請求大小限制，0為不限制，參數需在使用前設置
+// Sizer limits request sizes, 0 means unlimited
+type Sizer struct {
+	MaxBody        int64 // 請求體最大字節數
+	MaxHeaders     int   // 請求頭最大數量
+	MaxHeaderBytes int   // 請求頭總字節數，同時設置http.Server.MaxHeaderBytes
+	MaxQuery       int   // 查詢字符串最大長度
+	MaxParts       int   // multipart最大部分數
+	mu             sync.RWMutex
+	routes         map[string]int64 // 路徑對應的請求體限制
+}
+
+func NewSizer() *Sizer {
+	return &Sizer{routes: make(map[string]int64)}
+}
+
+// SetBody 設置路徑的請求體限制，覆蓋MaxBody，0為不限制
+// SetBody sets the body limit of a path, overriding MaxBody, 0 means unlimited
+func (this *Sizer) SetBody(path string, n int64) {
+	this.mu.Lock()
+	this.routes[path] = n
+	this.mu.Unlock()
+}
+
+// 路徑的請求體限制
+func (this *Sizer) bodyLimit(path string) int64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if n, ok := this.routes[path]; ok {
+		return n
+	}
+	return this.MaxBody
+}
+
+// Check 檢查請求頭和查詢字符串，限制path的請求體，超過限制時返回帶狀態碼的錯誤
+// Check checks the headers and query string and limits the body for path, returning an error with the status code when a limit is exceeded
+func (this *Sizer) Check(w http.ResponseWriter, r *http.Request, path string) error {
+	if this.MaxHeaders > 0 || this.MaxHeaderBytes > 0 {
+		count, size := 0, 0
+		for key, vals := range r.Header {
+			for _, v := range vals {
+				count++
+				size += len(key) + len(v) + 4 // ": "和"\r\n"
+			}
+		}
+		if this.MaxHeaders > 0 && count > this.MaxHeaders || this.MaxHeaderBytes > 0 && size > this.MaxHeaderBytes {
+			return NewHttpError(http.StatusRequestHeaderFieldsTooLarge, "Request Header Fields Too Large")
+		}
+	}
+	if this.MaxQuery > 0 && len(r.URL.RawQuery) > this.MaxQuery {
+		return NewHttpError(http.StatusRequestURITooLong, "URI Too Long")
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if n := this.bodyLimit(path); n > 0 {
+		if r.ContentLength > n {
+			return NewHttpError(http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+	}
+	if this.MaxParts > 0 {
+		if boundary := multipartBoundary(r); boundary != "" {
+			r.Body = &partCounter{ReadCloser: r.Body, delim: []byte("--" + boundary), max: this.MaxParts}
+		}
+	}
+	return nil
+}
+
+func (this *Sizer) String() string {
+	return fmt.Sprintf("&{MaxBody:%d MaxHeaders:%d MaxHeaderBytes:%d MaxQuery:%d MaxParts:%d Routes:%v}",
+		this.MaxBody, this.MaxHeaders, this.MaxHeaderBytes, this.MaxQuery, this.MaxParts, this.routes)
+}
+
+// multipart請求的分隔符，其他請求返回空
+func multipartBoundary(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// 統計請求體中的分隔符，n個部分有n+1個分隔符
+type partCounter struct {
+	io.ReadCloser
+	delim []byte
+	max   int
+	count int
+	tail  []byte // 上次讀取的末尾，分隔符可能跨兩次讀取
+}
+
+func (this *partCounter) Read(p []byte) (int, error) {
+	n, err := this.ReadCloser.Read(p)
+	if n > 0 {
+		buf := append(this.tail, p[:n]...)
+		this.count += bytes.Count(buf, this.delim)
+		keep := min(len(this.delim)-1, len(buf))
+		this.tail = append(this.tail[:0], buf[len(buf)-keep:]...)
+		if this.count-1 > this.max {
+			return n, ErrTooManyParts
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package goweber
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSizerServe(t *testing.T) {
+	app := newTestApp(t)
+	app.sizer.MaxBody = 1024
+	app.sizer.MaxHeaders = 10
+	app.sizer.MaxQuery = 100
+	app.BodyLimit("/upload", 4096)
+	read := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			app.Error(w, err)
+		}
+	}
+	app.Post("/echo", read)
+	app.Post("/upload", read)
+	send := func(target string, body io.Reader, header http.Header) int {
+		r := httptest.NewRequest("POST", target, body)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := send("/echo", strings.NewReader(strings.Repeat("a", 1024)), nil); code != 200 {
+		t.Fatalf("body at limit %d", code)
+	}
+	// 聲明的長度超過限制
+	if code := send("/echo", strings.NewReader(strings.Repeat("a", 1025)), nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("content length %d", code)
+	}
+	// 未聲明長度，讀取時超過限制
+	if code := send("/echo", io.MultiReader(strings.NewReader(strings.Repeat("a", 2000))), nil); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked %d", code)
+	}
+	if code := send("/upload", strings.NewReader(strings.Repeat("a", 4000)), nil); code != 200 {
+		t.Fatalf("route limit %d", code)
+	}
+	if code := send("/echo?"+strings.Repeat("q", 101), nil, nil); code != http.StatusRequestURITooLong {
+		t.Fatalf("query %d", code)
+	}
+	header := http.Header{}
+	for i := 0; i < 11; i++ {
+		header.Set("X-Test-"+string(rune('a'+i)), "1")
+	}
+	if code := send("/echo", nil, header); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("headers %d", code)
+	}
+}
+
+func TestSizerParts(t *testing.T) {
+	sizer := NewSizer()
+	sizer.MaxParts = 3
+	form := func(parts int) *http.Request {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.SetBoundary("b")
+		for i := 0; i < parts; i++ {
+			mw.WriteField("f", "v")
+		}
+		mw.Close()
+		r := httptest.NewRequest("POST", "/", &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+	for parts, ok := range map[int]bool{3: true, 4: false} {
+		r := form(parts)
+		if err := sizer.Check(httptest.NewRecorder(), r, "/"); err != nil {
+			t.Fatal(err)
+		}
+		// 分隔符很短，逐字節讀取時跨讀取邊界
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(oneByteReader{r.Body}, 1<<20), r.Body}
+		err := r.ParseMultipartForm(1 << 20)
+		if ok != (err == nil) {
+			t.Fatalf("%d parts: %v", parts, err)
+		}
+		if !ok && err != nil && !strings.Contains(err.Error(), "Too Many Parts") {
+			t.Fatalf("%d parts: %v", parts, err)
+		}
+	}
+}
+
+type oneByteReader struct{ r io.Reader }
+
+func (this oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return this.r.Read(p[:1])
+}
@@ -0,0 +1,147 @@
+// * 封禁列表快照
+// * 定時及關閉時把Store中的封禁列表和解封時間寫入本地文件，啓動時重新加載，重啓服務不會解封攻擊者
+// * 先寫入同目錄臨時文件再重命名，寫入過程中崩潰不會損壞原文件
+package goweber
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Snapshoter 封禁列表快照，參數需在使用前設置
+// Snapshoter saves block lists to a local file and restores them at startup
+type Snapshoter struct {
+	File      string          // 快照文件
+	Interval  int             // 定時保存間隔秒，0為只在關閉時保存
+	Prefixes  []string        // 保存的key前綴，默認為Rater和Bruter的封禁列表及手動封禁
+	OnError   func(err error) // 定時保存出錯時調用
+	store     Store
+	mu        sync.Mutex // 保證同一時間只有一個寫入
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// 快照文件格式
+type snapshot struct {
+	Version int             `json:"version"`
+	Time    time.Time       `json:"time"`
+	Blocks  []snapshotBlock `json:"blocks"`
+}
+
+type snapshotBlock struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+func NewSnapshoter(file string, store Store) *Snapshoter {
+	return &Snapshoter{
+		File:     file,
+		Interval: 60,
+		Prefixes: []string{storeRateBlock, storeBruteBlock, storeAccessBan},
+		store:    store,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Save 寫入快照
+// Save writes the snapshot
+func (this *Snapshoter) Save() error {
+	snap := snapshot{Version: 1, Time: time.Now(), Blocks: []snapshotBlock{}}
+	for _, prefix := range this.Prefixes {
+		entries, err := this.store.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			snap.Blocks = append(snap.Blocks, snapshotBlock{Key: e.Key, Until: e.Expire})
+		}
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return writeFileAtomic(this.File, data)
+}
+
+// Load 加載快照，文件不存在時忽略，已過期的封禁跳過
+// Load restores the snapshot, a missing file is ignored and expired blocks are skipped
+func (this *Snapshoter) Load() error {
+	data, err := os.ReadFile(this.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, b := range snap.Blocks {
+		if !b.Until.IsZero() && !now.Before(b.Until) {
+			continue
+		}
+		if err := this.store.SetBlock(b.Key, b.Until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run 定時保存，Close後停止
+// Run saves periodically until Close
+func (this *Snapshoter) Run() {
+	if this.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(this.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			if err := this.Save(); err != nil && this.OnError != nil {
+				this.OnError(err)
+			}
+		}
+	}
+}
+
+// Close 停止定時保存并寫入最後一次快照
+// Close stops periodic saving and writes a final snapshot
+func (this *Snapshoter) Close() error {
+	err := os.ErrClosed
+	this.closeOnce.Do(func() {
+		close(this.stop)
+		err = this.Save()
+	})
+	return err
+}
+
+// 寫入同目錄臨時文件，同步到磁盤後重命名
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
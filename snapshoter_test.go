@@ -0,0 +1,67 @@
+package goweber
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocks.json")
+	rater := NewRater()
+	defer rater.Close()
+	rater.SetStart(1)
+	rater.ErrMax = 1
+	rater.SetStatus("1.2.3.4")
+	bruter := NewBruter()
+	defer bruter.Close()
+	bruter.Store = rater.Store
+	bruter.MaxErr = 1
+	bruter.SetStatus("5.6.7.8")
+	rater.Store.SetBlock(storeRateBlock+"9.9.9.9", time.Now().Add(time.Millisecond))
+
+	snap := NewSnapshoter(file, rater.Store)
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(file + ".tmp*"); len(matches) != 0 {
+		t.Fatalf("temporary files left %v", matches)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// 重啓後使用新的存儲加載
+	restored := NewRater()
+	defer restored.Close()
+	restored.SetStart(1)
+	if err := NewSnapshoter(file, restored.Store).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.IsBlocked("1.2.3.4") || restored.IsBlocked("9.9.9.9") {
+		t.Fatalf("restored blocks %v", restored.Blocked())
+	}
+	until, ok := bruter.BlockedUntil("5.6.7.8")
+	if e, found, _ := restored.Store.Get(storeBruteBlock + "5.6.7.8"); !ok || !found || !e.Expire.Equal(until) {
+		t.Fatalf("bruter block %v %v", e, found)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocks.json")
+	snap := NewSnapshoter(file, NewMemoryStore())
+	if err := snap.Load(); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	os.WriteFile(file, []byte("{"), 0600)
+	if err := snap.Load(); err == nil {
+		t.Fatal("corrupt file accepted")
+	}
+	// 保存失敗時原文件不變
+	snap.File = filepath.Join(file, "missing", "blocks.json")
+	if err := snap.Save(); err == nil {
+		t.Fatal("save into missing directory succeeded")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "{" {
+		t.Fatalf("original file changed: %q", data)
+	}
+}
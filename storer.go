@@ -0,0 +1,227 @@
+// * 計數存儲
+// * Rater和Bruter的錯誤計數和封禁列表保存在Store中
+// * 單進程使用MemoryStore，多實例部署時使用Rediser共享計數，避免攻擊者在每個實例各得一份額度
+// * 只有404封禁和暴力破解的計數及封禁列表保存在Store中；請求限流(Rater.Limit)和命名限流策略的計數仍在進程内，N個實例時額度為N倍，需按實例數調低rate
+package goweber
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StoreEntry 存儲條目
+// StoreEntry is a stored counter or block
+type StoreEntry struct {
+	Key    string
+	Value  int64
+	Expire time.Time // 過期時間，零值為不過期
+}
+
+// Store 計數存儲接口，實現需并發安全
+// Store is the counter storage interface, implementations must be safe for concurrent use
+type Store interface {
+	// Incr 計數加1並返回新值，key不存在或已過期時重新計數并在ttl後過期
+	Incr(key string, ttl time.Duration) (int64, error)
+	// Get 讀取條目，不存在或已過期時返回false
+	Get(key string) (StoreEntry, bool, error)
+	// SetBlock 設置封禁，until後過期，零值為永久
+	SetBlock(key string, until time.Time) error
+	// Delete 刪除key
+	Delete(key string) error
+	// List 列出前綴為prefix的未過期條目
+	List(prefix string) ([]StoreEntry, error)
+	// Close 釋放資源
+	Close() error
+}
+
+// Rater和Bruter使用的key前綴，共用一個Store時互不影響
+const (
+	storeRateErr    = "rate:err:"
+	storeRateBlock  = "rate:block:"
+	storeRateEsc    = "rate:esc:" // 升級前綴内的封禁數量
+	storeBruteErr   = "brute:err:"
+	storeBruteBlock = "brute:block:"
+	storeBruteEsc   = "brute:esc:"
+	storeBruteLevel = "brute:level:" // 重複封禁次數
+	storeAccessBan  = "access:ban:"  // Accesser的手動封禁
+)
+
+// MemoryStore 進程内存儲，過期條目在讀取時或Clear時刪除
+// MemoryStore is an in-process store, expired entries are removed on access or by Clear
+type MemoryStore struct {
+	data   *shardMap[StoreEntry]
+	counts sync.Map // 按key前綴(如rate:err:)統計的條目數，*atomic.Int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: newShardMap[StoreEntry]()}
+}
+
+// 鎖定key所在分片，按key是否新增或刪除更新前綴計數
+func (this *MemoryStore) do(key string, f func(m map[string]StoreEntry)) {
+	this.data.Do(key, func(m map[string]StoreEntry) {
+		_, before := m[key]
+		f(m)
+		if _, after := m[key]; before != after {
+			this.count(key, after)
+		}
+	})
+}
+
+// 前綴計數加減1
+func (this *MemoryStore) count(key string, added bool) {
+	c, ok := this.counts.Load(storePrefix(key))
+	if !ok {
+		c, _ = this.counts.LoadOrStore(storePrefix(key), new(atomic.Int64))
+	}
+	if added {
+		c.(*atomic.Int64).Add(1)
+	} else {
+		c.(*atomic.Int64).Add(-1)
+	}
+}
+
+// 前綴為prefix的條目數量，包括未清理的過期條目，prefix為storeRateErr等完整前綴
+func (this *MemoryStore) prefixLen(prefix string) int {
+	if c, ok := this.counts.Load(prefix); ok {
+		return int(c.(*atomic.Int64).Load())
+	}
+	return 0
+}
+
+// key的前綴，到第二個冒號為止
+func storePrefix(key string) string {
+	i := strings.IndexByte(key, ':')
+	if i < 0 {
+		return ""
+	}
+	j := strings.IndexByte(key[i+1:], ':')
+	if j < 0 {
+		return ""
+	}
+	return key[:i+j+2]
+}
+
+func (this *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	var n int64
+	now := time.Now()
+	this.do(key, func(m map[string]StoreEntry) {
+		e, ok := m[key]
+		if !ok || e.expired(now) {
+			e = StoreEntry{Key: key, Expire: now.Add(ttl)}
+		}
+		e.Value++
+		m[key] = e
+		n = e.Value
+	})
+	return n, nil
+}
+
+func (this *MemoryStore) Get(key string) (StoreEntry, bool, error) {
+	e, ok := this.data.Get(key)
+	if !ok {
+		return e, false, nil
+	}
+	if e.expired(time.Now()) {
+		// 刪除期間可能被重新寫入，需再次判斷
+		this.do(key, func(m map[string]StoreEntry) {
+			if e, ok := m[key]; ok && e.expired(time.Now()) {
+				delete(m, key)
+			}
+		})
+		return StoreEntry{}, false, nil
+	}
+	return e, true, nil
+}
+
+func (this *MemoryStore) SetBlock(key string, until time.Time) error {
+	this.do(key, func(m map[string]StoreEntry) { m[key] = StoreEntry{Key: key, Value: 1, Expire: until} })
+	return nil
+}
+
+func (this *MemoryStore) Delete(key string) error {
+	this.do(key, func(m map[string]StoreEntry) { delete(m, key) })
+	return nil
+}
+
+func (this *MemoryStore) List(prefix string) ([]StoreEntry, error) {
+	var res []StoreEntry
+	now := time.Now()
+	this.data.Each(func(m map[string]StoreEntry) {
+		for key, e := range m {
+			if strings.HasPrefix(key, prefix) && !e.expired(now) {
+				res = append(res, e)
+			}
+		}
+	})
+	return res, nil
+}
+
+// Clear 刪除所有過期條目
+// Clear removes all expired entries
+func (this *MemoryStore) Clear() {
+	now := time.Now()
+	this.data.Each(func(m map[string]StoreEntry) {
+		for key, e := range m {
+			if e.expired(now) {
+				delete(m, key)
+				this.count(key, false)
+			}
+		}
+	})
+}
+
+// 前綴為prefix的條目超過max時刪除，直到不超過max的9/10，留出餘量避免每次寫入都掃描
+func (this *MemoryStore) trim(prefix string, max int) {
+	if this.prefixLen(prefix) <= max {
+		return
+	}
+	target := max - max/10
+	this.data.Each(func(m map[string]StoreEntry) {
+		for key := range m {
+			if this.prefixLen(prefix) <= target {
+				return
+			}
+			if strings.HasPrefix(key, prefix) {
+				delete(m, key)
+				this.count(key, false)
+			}
+		}
+	})
+}
+
+// Len 條目數量，包括未清理的過期條目
+// Len is the number of entries, including expired entries not yet cleared
+func (this *MemoryStore) Len() int {
+	return this.data.Len()
+}
+
+func (this *MemoryStore) Close() error {
+	return nil
+}
+
+func (this StoreEntry) expired(now time.Time) bool {
+	return !this.Expire.IsZero() && !now.Before(this.Expire)
+}
+
+// 清理進程内存儲的過期條目，其他存儲自行過期
+func clearStore(store Store) {
+	if ms, ok := store.(*MemoryStore); ok {
+		ms.Clear()
+	}
+}
+
+// 寫入前調用，進程内存儲中前綴為prefix的計數達到max時按t限頻清理過期條目，仍達到時刪除該前綴的計數
+// 只統計和刪除該前綴的條目，封禁等其他條目不佔用名額也不被刪除，其他存儲自行過期
+func trimStore(store Store, max int, prefix string, t *throttle) {
+	ms, ok := store.(*MemoryStore)
+	if !ok || ms.prefixLen(prefix) < max {
+		return
+	}
+	if t.allow(time.Now(), time.Second) {
+		ms.Clear()
+	}
+	ms.trim(prefix, max-1) // 為新key留出位置
+}
@@ -0,0 +1,558 @@
+// * TLS配置
+// * 支持最低/最高版本、加密套件、曲綫偏好、按SNI選擇多張證書，以及證書文件變更後自動重新加載
+// * 支持客戶端證書認證(mTLS)，CA證書驗證及CRL吊銷檢查
+// * CRL超過NextUpdate後視為過期：加載時報錯，已加載的過期CRL拒絕所有客戶端證書直到更新
+package goweber
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCRLExpired 吊銷列表已超過NextUpdate
+// ErrCRLExpired is returned when the revocation list is past its NextUpdate
+var ErrCRLExpired = errors.New("tls吊銷列表已過期")
+
+// Tlser TLS配置結構
+// Tlser holds the TLS settings used by RunTLS
+type Tlser struct {
+	sync.RWMutex
+	MinVersion       uint16             // 最低TLS版本
+	MaxVersion       uint16             // 最高TLS版本，0為不限制
+	CipherSuites     []uint16           // 加密套件，僅對TLS1.2及以下有效，空為默認
+	CurvePreferences []tls.CurveID      // 曲綫偏好，空為默認
+	CertFiles        []string           // 證書文件，與KeyFiles一一對應
+	KeyFiles         []string           // 私鑰文件
+	Reload           int                // 證書文件檢查周期，單位秒，0為不自動重新加載
+	ClientAuth       tls.ClientAuthType // 客戶端證書模式
+	ClientCA         string             // 客戶端CA證書文件，PEM格式，可包含多張
+	CRL              string             // 證書吊銷列表文件，PEM或DER格式
+	// 證書重新加載時回調，err不為nil時表示加載失敗，繼續使用舊證書
+	// Called after a reload attempt, err != nil means the old certificate is kept
+	OnReload func(certFile string, err error)
+	certs    []*tlsCert
+	ca       *tlsCA
+	stop     chan struct{}
+}
+
+// 已加載的客戶端CA及吊銷列表
+type tlsCA struct {
+	caFile  string
+	crlFile string
+	modTime time.Time
+	pool    *x509.CertPool
+	// 吊銷的證書序列號，key為簽發者RawSubject+序列號
+	revoked map[string]bool
+	// CRL的下次更新時間，零值為未配置CRL或CRL未設置
+	nextUpdate time.Time
+	warned     atomic.Bool // 已通知過期
+}
+
+// CRL是否已過期
+func (this *tlsCA) expired(now time.Time) bool {
+	return !this.nextUpdate.IsZero() && now.After(this.nextUpdate)
+}
+
+// CertIdentity 客戶端證書身份
+// CertIdentity is the identity carried by a client certificate
+type CertIdentity struct {
+	Subject        string   // 完整主題
+	CommonName     string   // CN
+	Organization   []string // O
+	DNSNames       []string // SAN DNS
+	EmailAddresses []string // SAN Email
+	IPAddresses    []string // SAN IP
+	URIs           []string // SAN URI，如spiffe://
+	Serial         string   // 序列號
+	Issuer         string   // 簽發者
+	Verified       bool     // 是否已通過CA驗證
+}
+
+// Names 返回CN及所有SAN，用於授權比對
+// Names returns the CN and all SANs for authorization checks
+func (this *CertIdentity) Names() []string {
+	names := []string{}
+	if this.CommonName != "" {
+		names = append(names, this.CommonName)
+	}
+	names = append(names, this.DNSNames...)
+	names = append(names, this.EmailAddresses...)
+	names = append(names, this.IPAddresses...)
+	names = append(names, this.URIs...)
+	return names
+}
+
+// 已加載的證書
+type tlsCert struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// NewTlser 創建默認TLS配置，最低TLS1.2
+// NewTlser creates a TLS configuration with TLS 1.2 as the minimum version
+func NewTlser() *Tlser {
+	return &Tlser{
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// AddCert 添加一對證書文件，需在Load之前調用
+// AddCert adds a certificate/key pair, must be called before Load
+func (this *Tlser) AddCert(certFile, keyFile string) {
+	this.Lock()
+	defer this.Unlock()
+	this.CertFiles = append(this.CertFiles, certFile)
+	this.KeyFiles = append(this.KeyFiles, keyFile)
+}
+
+// Load 加載所有證書，第一張證書為SNI無法匹配時的默認證書，出錯時保留原有配置
+// Load loads all certificates, the first one is the default when SNI does not match, the previous state is kept on error
+func (this *Tlser) Load() error {
+	this.Lock()
+	defer this.Unlock()
+	if len(this.CertFiles) == 0 {
+		return errors.New("tls未配置證書")
+	}
+	if len(this.CertFiles) != len(this.KeyFiles) {
+		return errors.New("tls證書與私鑰數量不一致")
+	}
+	if this.CRL != "" && this.ClientCA == "" {
+		return errors.New("tls配置crl需同時配置clientca")
+	}
+	if this.ClientAuth >= tls.VerifyClientCertIfGiven && this.ClientCA == "" {
+		return errors.New("tls客戶端證書驗證模式需配置clientca")
+	}
+	certs := make([]*tlsCert, 0, len(this.CertFiles))
+	for i := range this.CertFiles {
+		c := &tlsCert{certFile: this.CertFiles[i], keyFile: this.KeyFiles[i]}
+		if err := c.load(); err != nil {
+			return err
+		}
+		certs = append(certs, c)
+	}
+	var ca *tlsCA
+	if this.ClientCA != "" {
+		ca = &tlsCA{caFile: this.ClientCA, crlFile: this.CRL}
+		if err := ca.load(); err != nil {
+			return err
+		}
+	}
+	// 全部檢查通過後才替換，失敗時保留原有證書和CA
+	this.certs = certs
+	this.ca = ca
+	return nil
+}
+
+// 讀取CA證書和吊銷列表
+func (this *tlsCA) load() error {
+	modTime, err := this.lastModified()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(this.caFile)
+	if err != nil {
+		return err
+	}
+	var cas []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		cas = append(cas, cert)
+	}
+	if len(cas) == 0 {
+		return errors.New("tls客戶端CA文件中沒有證書:" + this.caFile)
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	revoked := make(map[string]bool)
+	if this.crlFile != "" {
+		data, err := os.ReadFile(this.crlFile)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return err
+		}
+		// CRL必須由配置的CA簽發
+		var issuer *x509.Certificate
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				issuer = ca
+				break
+			}
+		}
+		if issuer == nil {
+			return errors.New("tls吊銷列表簽名校驗失敗:" + this.crlFile)
+		}
+		this.nextUpdate = crl.NextUpdate
+		if this.expired(time.Now()) {
+			return fmt.Errorf("%w: %s", ErrCRLExpired, this.crlFile)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[string(crl.RawIssuer)+entry.SerialNumber.String()] = true
+		}
+	}
+	this.pool = pool
+	this.revoked = revoked
+	this.modTime = modTime
+	return nil
+}
+
+// CA和吊銷列表中最近的修改時間
+func (this *tlsCA) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{this.caFile, this.crlFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// VerifyConnection 檢查客戶端證書鏈是否被吊銷，CRL過期時拒絕所有客戶端證書，用於tls.Config.VerifyConnection
+// VerifyConnection rejects client certificate chains containing revoked certificates, and every client certificate while the CRL is expired
+func (this *Tlser) VerifyConnection(cs tls.ConnectionState) error {
+	this.RLock()
+	ca := this.ca
+	this.RUnlock()
+	if ca == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	if ca.expired(time.Now()) {
+		return fmt.Errorf("%w: %s", ErrCRLExpired, ca.crlFile)
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if ca.revoked[string(cert.RawIssuer)+cert.SerialNumber.String()] {
+				return errors.New("tls客戶端證書已被吊銷:" + cert.Subject.String())
+			}
+		}
+	}
+	return nil
+}
+
+// 每次握手使用最新的CA，使CA和CRL重新加載後立即生效
+func (this *Tlser) getConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		this.RLock()
+		ca := this.ca
+		this.RUnlock()
+		if ca == nil {
+			return nil, nil
+		}
+		conf := base.Clone()
+		conf.ClientCAs = ca.pool
+		conf.GetConfigForClient = nil
+		return conf, nil
+	}
+}
+
+// Identity 獲取請求的客戶端證書身份，沒有證書時返回nil
+// Identity returns the client certificate identity of the request, nil when none was presented
+func (this *Tlser) Identity(r *http.Request) *CertIdentity {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	id := &CertIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		Organization:   cert.Subject.Organization,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Serial:         cert.SerialNumber.String(),
+		Issuer:         cert.Issuer.String(),
+		Verified:       len(r.TLS.VerifiedChains) > 0,
+	}
+	for _, ip := range cert.IPAddresses {
+		id.IPAddresses = append(id.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+	return id
+}
+
+// 讀取證書文件
+func (this *tlsCert) load() error {
+	modTime, err := this.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(this.certFile, this.keyFile)
+	if err != nil {
+		return err
+	}
+	this.cert = &cert
+	this.modTime = modTime
+	return nil
+}
+
+// 證書和私鑰中最近的修改時間
+func (this *tlsCert) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, name := range []string{this.certFile, this.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// GetCertificate 根據SNI選擇證書，用於tls.Config.GetCertificate
+// GetCertificate selects a certificate by SNI, used as tls.Config.GetCertificate
+func (this *Tlser) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	this.RLock()
+	defer this.RUnlock()
+	if len(this.certs) == 0 {
+		return nil, errors.New("tls未加載證書")
+	}
+	if hello.ServerName != "" {
+		for _, c := range this.certs {
+			if hello.SupportsCertificate(c.cert) == nil {
+				return c.cert, nil
+			}
+		}
+	}
+	return this.certs[0].cert, nil
+}
+
+// Config 生成tls.Config
+// Config builds the tls.Config for the server
+func (this *Tlser) Config() *tls.Config {
+	this.RLock()
+	defer this.RUnlock()
+	conf := &tls.Config{
+		MinVersion:       this.MinVersion,
+		MaxVersion:       this.MaxVersion,
+		CipherSuites:     this.CipherSuites,
+		CurvePreferences: this.CurvePreferences,
+		GetCertificate:   this.GetCertificate,
+		ClientAuth:       this.ClientAuth,
+		VerifyConnection: this.VerifyConnection,
+	}
+	conf.GetConfigForClient = this.getConfigForClient(conf)
+	return conf
+}
+
+// Watch 定時檢查證書文件，變更後重新加載，Close後退出
+// Watch periodically checks certificate files and reloads changed ones until Close
+func (this *Tlser) Watch() {
+	if this.Reload <= 0 {
+		return
+	}
+	this.Lock()
+	if this.stop != nil {
+		this.Unlock()
+		return
+	}
+	this.stop = make(chan struct{})
+	stop := this.stop
+	this.Unlock()
+
+	ticker := time.NewTicker(time.Duration(this.Reload) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			this.reload()
+		}
+	}
+}
+
+// 重新加載已變更的證書，失敗時保留舊證書
+func (this *Tlser) reload() {
+	this.RLock()
+	certs := this.certs
+	this.RUnlock()
+	for i, c := range certs {
+		modTime, err := c.lastModified()
+		if err != nil || !modTime.After(c.modTime) {
+			continue
+		}
+		fresh := &tlsCert{certFile: c.certFile, keyFile: c.keyFile}
+		err = fresh.load()
+		if err == nil {
+			// 期間Load替換了證書列表時放棄，寫入新列表避免與讀取者競爭
+			this.Lock()
+			if i < len(this.certs) && this.certs[i] == c {
+				updated := slices.Clone(this.certs)
+				updated[i] = fresh
+				this.certs = updated
+			}
+			this.Unlock()
+		}
+		if this.OnReload != nil {
+			this.OnReload(c.certFile, err)
+		}
+	}
+	this.RLock()
+	ca := this.ca
+	this.RUnlock()
+	if ca == nil {
+		return
+	}
+	modTime, err := ca.lastModified()
+	if err != nil || !modTime.After(ca.modTime) {
+		// 文件未更新而CRL已過期，通知一次
+		if ca.expired(time.Now()) && !ca.warned.Swap(true) && this.OnReload != nil {
+			this.OnReload(ca.crlFile, fmt.Errorf("%w: %s", ErrCRLExpired, ca.crlFile))
+		}
+		return
+	}
+	fresh := &tlsCA{caFile: ca.caFile, crlFile: ca.crlFile}
+	err = fresh.load()
+	if err == nil {
+		this.Lock()
+		if this.ca == ca {
+			this.ca = fresh
+		}
+		this.Unlock()
+	}
+	if this.OnReload != nil {
+		this.OnReload(ca.caFile, err)
+	}
+}
+
+// Close 停止證書檢查
+// Close stops the certificate watcher
+func (this *Tlser) Close() {
+	this.Lock()
+	defer this.Unlock()
+	if this.stop != nil {
+		close(this.stop)
+		this.stop = nil
+	}
+}
+
+// ParseTlsVersion 解析版本字符串，如1.2、1.3
+// ParseTlsVersion parses a version string such as 1.2 or 1.3
+func ParseTlsVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.New("不支持的tls版本:" + s)
+}
+
+// ParseClientAuth 解析客戶端證書模式
+// none 不要求，request 請求但不驗證，require 必須提供但不驗證，verify 必須提供並驗證，verifyifgiven 提供時驗證
+// ParseClientAuth parses the client certificate mode: none, request, require, verify or verifyifgiven
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify":
+		return tls.RequireAndVerifyClientCert, nil
+	case "verifyifgiven":
+		return tls.VerifyClientCertIfGiven, nil
+	}
+	return tls.NoClientCert, errors.New("不支持的客戶端證書模式:" + s)
+}
+
+// ParseCipherSuites 解析逗號分隔的加密套件名稱，如TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// ParseCipherSuites parses comma separated cipher suite names
+func ParseCipherSuites(s string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range splitList(s) {
+		found := false
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("不支持的加密套件:" + name)
+		}
+	}
+	return ids, nil
+}
+
+// ParseCurves 解析逗號分隔的曲綫名稱，如X25519,P256
+// ParseCurves parses comma separated curve names such as X25519,P256
+func ParseCurves(s string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range splitList(s) {
+		switch strings.ToUpper(name) {
+		case "X25519":
+			ids = append(ids, tls.X25519)
+		case "X25519MLKEM768":
+			ids = append(ids, tls.X25519MLKEM768)
+		case "P256", "P-256":
+			ids = append(ids, tls.CurveP256)
+		case "P384", "P-384":
+			ids = append(ids, tls.CurveP384)
+		case "P521", "P-521":
+			ids = append(ids, tls.CurveP521)
+		default:
+			return nil, errors.New("不支持的曲綫:" + name)
+		}
+	}
+	return ids, nil
+}
+
+// 分割逗號列表，去除空白和空項
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
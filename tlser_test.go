@@ -0,0 +1,412 @@
+package goweber
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 測試用證書，ca為nil時自簽
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, ca *testCert, serial int64, cn string, dnsNames ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// 寫入PEM證書和私鑰，返回文件路徑
+func (this *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(this.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: this.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// 寫入由ca簽發的CRL，next為下次更新時間
+func (this *testCert) writeCRL(t *testing.T, file string, next time.Time, serials ...int64) {
+	t.Helper()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: next,
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now().Add(-time.Minute)})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, this.cert, this.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTlserSNI(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, 1, "test ca")
+	a := newTestCert(t, ca, 2, "a.test", "a.test")
+	b := newTestCert(t, ca, 3, "b.test", "b.test", "*.b.test")
+	tlser := NewTlser()
+	tlser.AddCert(a.write(t, dir, "a"))
+	tlser.AddCert(b.write(t, dir, "b"))
+	if err := tlser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]*testCert{"a.test": a, "b.test": b, "x.b.test": b, "other.test": a, "": a} {
+		cert, err := tlser.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        name,
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf == nil || !cert.Leaf.Equal(want.cert) {
+			t.Fatalf("%q got %v", name, cert.Leaf.Subject)
+		}
+	}
+}
+
+func TestTlserReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, 1, "test ca")
+	old := newTestCert(t, ca, 2, "old.test", "old.test")
+	certFile, keyFile := old.write(t, dir, "server")
+	tlser := NewTlser()
+	tlser.AddCert(certFile, keyFile)
+	if err := tlser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var reloaded []error
+	tlser.OnReload = func(file string, err error) {
+		reloaded = append(reloaded, err)
+	}
+	current := func() *x509.Certificate {
+		cert, _ := tlser.GetCertificate(&tls.ClientHelloInfo{})
+		return cert.Leaf
+	}
+	touch := func(d time.Duration) {
+		for _, name := range []string{certFile, keyFile} {
+			os.Chtimes(name, time.Now().Add(d), time.Now().Add(d))
+		}
+	}
+
+	// 未變更時不重新加載
+	tlser.reload()
+	if len(reloaded) != 0 {
+		t.Fatalf("reloaded %v", reloaded)
+	}
+	// 損壞的證書保留舊證書
+	os.WriteFile(certFile, []byte("broken"), 0600)
+	touch(time.Minute)
+	tlser.reload()
+	if len(reloaded) != 1 || reloaded[0] == nil || !current().Equal(old.cert) {
+		t.Fatalf("reloaded %v", reloaded)
+	}
+	// 新證書替換
+	fresh := newTestCert(t, ca, 3, "new.test", "new.test")
+	fresh.write(t, dir, "server")
+	touch(2 * time.Minute)
+	tlser.reload()
+	if len(reloaded) != 2 || reloaded[1] != nil || !current().Equal(fresh.cert) {
+		t.Fatalf("reloaded %v", reloaded)
+	}
+}
+
+func TestTlserReloadLoad(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, 1, "test ca")
+	tlser := NewTlser()
+	for i, name := range []string{"a", "b"} {
+		certFile, keyFile := newTestCert(t, ca, int64(i+2), name+".test", name+".test").write(t, dir, name)
+		tlser.AddCert(certFile, keyFile)
+	}
+	if err := tlser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// 重新加載與Load并發時不寫入舊列表
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			tlser.Load()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		at := time.Now().Add(time.Duration(i+1) * time.Second)
+		for _, name := range []string{"a", "b"} {
+			os.Chtimes(filepath.Join(dir, name+".crt"), at, at)
+		}
+		tlser.reload()
+	}
+	<-done
+	tlser.RLock()
+	defer tlser.RUnlock()
+	if len(tlser.certs) != 2 || tlser.certs[0].certFile != tlser.CertFiles[0] || tlser.certs[1].certFile != tlser.CertFiles[1] {
+		t.Fatalf("certs %v", tlser.certs)
+	}
+}
+
+func TestTlserLoadAtomic(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, 1, "test ca")
+	server := newTestCert(t, ca, 2, "server.test", "server.test")
+	tlser := NewTlser()
+	tlser.AddCert(server.write(t, dir, "server"))
+	if err := tlser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	// 再次加載時CA文件不存在，證書和CA都保持不變
+	other := newTestCert(t, ca, 3, "other.test", "other.test")
+	tlser.CertFiles[0], tlser.KeyFiles[0] = other.write(t, dir, "other")
+	tlser.ClientAuth = tls.RequireAndVerifyClientCert
+	tlser.ClientCA = filepath.Join(dir, "missing.crt")
+	if err := tlser.Load(); err == nil {
+		t.Fatal("應加載失敗")
+	}
+	cert, _ := tlser.GetCertificate(&tls.ClientHelloInfo{})
+	if !cert.Leaf.Equal(server.cert) || tlser.ca != nil {
+		t.Fatal("加載失敗後狀態被部分修改")
+	}
+	// 配置錯誤在讀取文件前返回
+	tlser.ClientCA = ""
+	tlser.CRL = filepath.Join(dir, "ca.crl")
+	if err := tlser.Load(); err == nil {
+		t.Fatal("crl需同時配置clientca")
+	}
+}
+
+func TestTlsParse(t *testing.T) {
+	for s, want := range map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, " 1.2 ": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		if v, err := ParseTlsVersion(s); err != nil || v != want {
+			t.Fatalf("%q got %x %v", s, v, err)
+		}
+	}
+	if _, err := ParseTlsVersion("1.4"); err == nil {
+		t.Fatal("1.4應不支持")
+	}
+
+	suites, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suites[1] != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+		t.Fatalf("got %v %v", suites, err)
+	}
+	if suites, err := ParseCipherSuites(""); err != nil || suites != nil {
+		t.Fatalf("empty got %v %v", suites, err)
+	}
+	if _, err := ParseCipherSuites("TLS_FAKE"); err == nil {
+		t.Fatal("TLS_FAKE應不支持")
+	}
+
+	curves, err := ParseCurves("x25519,P-256,P384")
+	if err != nil || len(curves) != 3 || curves[0] != tls.X25519 || curves[1] != tls.CurveP256 || curves[2] != tls.CurveP384 {
+		t.Fatalf("got %v %v", curves, err)
+	}
+	if _, err := ParseCurves("P192"); err == nil {
+		t.Fatal("P192應不支持")
+	}
+}
+
+// 啓動mTLS服務，響應客戶端證書的CN和是否已驗證
+func serveTls(t *testing.T, tlser *Tlser) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := tlser.Identity(r)
+			if id == nil {
+				io.WriteString(w, "none")
+				return
+			}
+			if id.Verified {
+				io.WriteString(w, "verified ")
+			}
+			io.WriteString(w, id.CommonName+" "+id.Serial+" "+id.DNSNames[0])
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go server.Serve(tls.NewListener(ln, tlser.Config()))
+	t.Cleanup(func() { server.Close() })
+	return "https://" + ln.Addr().String() + "/"
+}
+
+// 以client證書請求，client為nil時不提供證書
+func getTls(url string, client *testCert) (string, error) {
+	conf := &tls.Config{InsecureSkipVerify: true}
+	if client != nil {
+		conf.Certificates = []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}}
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: conf}}
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestTlserClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, 1, "client ca")
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, ca, 2, "server.test", "server.test")
+	alice := newTestCert(t, ca, 10, "alice", "alice.test")
+	mallory := newTestCert(t, newTestCert(t, nil, 1, "other ca"), 11, "mallory", "mallory.test")
+	newTlser := func(mode, clientCA, crl string) *Tlser {
+		tlser := NewTlser()
+		tlser.AddCert(server.write(t, dir, "server"))
+		tlser.ClientAuth, _ = ParseClientAuth(mode)
+		tlser.ClientCA = clientCA
+		tlser.CRL = crl
+		if err := tlser.Load(); err != nil {
+			t.Fatal(err)
+		}
+		return tlser
+	}
+
+	// request 可不提供證書，提供的證書不驗證
+	url := serveTls(t, newTlser("request", "", ""))
+	if body, err := getTls(url, nil); err != nil || body != "none" {
+		t.Fatalf("request got %q %v", body, err)
+	}
+	if body, err := getTls(url, mallory); err != nil || body != "mallory 11 mallory.test" {
+		t.Fatalf("request got %q %v", body, err)
+	}
+
+	// require 必須提供證書，不驗證
+	url = serveTls(t, newTlser("require", "", ""))
+	if _, err := getTls(url, nil); err == nil {
+		t.Fatal("require應拒絕無證書的客戶端")
+	}
+	if body, err := getTls(url, mallory); err != nil || body != "mallory 11 mallory.test" {
+		t.Fatalf("require got %q %v", body, err)
+	}
+
+	// verify 必須由clientca簽發
+	url = serveTls(t, newTlser("verify", caFile, ""))
+	if _, err := getTls(url, nil); err == nil {
+		t.Fatal("verify應拒絕無證書的客戶端")
+	}
+	if _, err := getTls(url, mallory); err == nil {
+		t.Fatal("verify應拒絕其他CA簽發的證書")
+	}
+	if body, err := getTls(url, alice); err != nil || body != "verified alice 10 alice.test" {
+		t.Fatalf("verify got %q %v", body, err)
+	}
+
+	// 已吊銷的證書被拒絕
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlFile, time.Now().Add(time.Hour), 12)
+	bob := newTestCert(t, ca, 12, "bob", "bob.test")
+	url = serveTls(t, newTlser("verify", caFile, crlFile))
+	if _, err := getTls(url, bob); err == nil {
+		t.Fatal("應拒絕已吊銷的證書")
+	}
+	if body, err := getTls(url, alice); err != nil || body != "verified alice 10 alice.test" {
+		t.Fatalf("crl got %q %v", body, err)
+	}
+}
+
+func TestTlserCRLExpired(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, 1, "client ca")
+	caFile, _ := ca.write(t, dir, "ca")
+	server := newTestCert(t, ca, 2, "server.test", "server.test")
+	alice := newTestCert(t, ca, 10, "alice", "alice.test")
+	crlFile := filepath.Join(dir, "ca.crl")
+	tlser := NewTlser()
+	tlser.AddCert(server.write(t, dir, "server"))
+	tlser.ClientAuth = tls.RequireAndVerifyClientCert
+	tlser.ClientCA = caFile
+	tlser.CRL = crlFile
+
+	// 加載時已過期
+	ca.writeCRL(t, crlFile, time.Now().Add(-time.Minute))
+	if err := tlser.Load(); !errors.Is(err, ErrCRLExpired) {
+		t.Fatalf("got %v", err)
+	}
+
+	// 加載後過期，拒絕客戶端證書並通知一次
+	ca.writeCRL(t, crlFile, time.Now().Add(time.Hour))
+	if err := tlser.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []error
+	tlser.OnReload = func(file string, err error) {
+		warnings = append(warnings, err)
+	}
+	url := serveTls(t, tlser)
+	if _, err := getTls(url, alice); err != nil {
+		t.Fatal(err)
+	}
+	tlser.ca.nextUpdate = time.Now().Add(-time.Second)
+	if _, err := getTls(url, alice); err == nil {
+		t.Fatal("CRL過期後應拒絕客戶端證書")
+	}
+	tlser.reload()
+	tlser.reload()
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrCRLExpired) {
+		t.Fatalf("warnings %v", warnings)
+	}
+}
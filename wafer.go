@@ -0,0 +1,368 @@
+// * Web應用防火牆
+// * 規則按行配置，格式見waf.rules：檢查路徑、查詢參數、請求頭、Cookie、請求體
+// * 匹配前解碼URL編碼、unicode轉義和HTML實體，防止編碼繞過
+// * block規則直接攔截，score規則累加分數，達到Threshold時攔截，log規則只記錄
+// * Detect為true時只記錄不攔截，用於上綫前觀察誤報
+package goweber
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//go:embed waf.rules
+var wafBaseline string
+
+// 規則動作
+const (
+	WafBlock = "block"
+	WafLog   = "log"
+	WafScore = "score"
+)
+
+// WafRule 一條規則
+// WafRule is one firewall rule
+type WafRule struct {
+	ID      string
+	Targets []string // path,query,headers,header:名稱,cookies,body
+	Op      string   // regex,contains,length
+	Action  string   // block,log,score
+	Score   int
+	Pattern string
+	re      *regexp.Regexp
+	length  int
+}
+
+// WafMatch 命中的規則
+// WafMatch is a rule hit
+type WafMatch struct {
+	Rule   *WafRule
+	Target string
+	Value  string // 命中的值，最多64字節
+}
+
+// WafResult 一個請求的檢查結果
+// WafResult is the outcome of inspecting one request
+type WafResult struct {
+	Matches []WafMatch
+	Score   int
+	Blocked bool // 應攔截，Detect時同樣設置
+}
+
+// Wafer Web應用防火牆，參數需在Load前設置
+// Wafer is a rule based web application firewall
+type Wafer struct {
+	Files     []string // 規則文件，為空時使用內置規則
+	Threshold int      // 攔截分數
+	Detect    bool     // 只記錄不攔截
+	MaxBody   int64    // 檢查的請求體字節數，0為不檢查請求體
+	// 有規則命中時調用
+	OnMatch func(r *http.Request, res WafResult)
+	mu      sync.RWMutex
+	rules   []*WafRule
+}
+
+func NewWafer() *Wafer {
+	return &Wafer{
+		Threshold: 5,
+		MaxBody:   64 << 10,
+	}
+}
+
+// Load 加載規則文件或內置規則
+// Load loads the rule files or the built-in rules
+func (this *Wafer) Load() error {
+	var rules []*WafRule
+	if len(this.Files) == 0 {
+		var err error
+		if rules, err = parseWafRules(strings.NewReader(wafBaseline), "waf.rules"); err != nil {
+			return err
+		}
+	}
+	for _, file := range this.Files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		r, err := parseWafRules(f, file)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r...)
+	}
+	this.mu.Lock()
+	this.rules = rules
+	this.mu.Unlock()
+	return nil
+}
+
+// Rules 當前規則
+// Rules returns the loaded rules
+func (this *Wafer) Rules() []*WafRule {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.rules
+}
+
+// Check 中間件，攔截時返回403，Detect時只記錄
+// Check is the middleware, returning 403 when blocked unless in detection mode
+func (this *Wafer) Check(r *http.Request) error {
+	res := this.Inspect(r)
+	if len(res.Matches) > 0 && this.OnMatch != nil {
+		this.OnMatch(r, res)
+	}
+	if res.Blocked && !this.Detect {
+		return NewHttpError(http.StatusForbidden, "Forbidden")
+	}
+	return nil
+}
+
+// Inspect 按規則檢查請求，不攔截
+// Inspect checks the request against the rules without blocking it
+func (this *Wafer) Inspect(r *http.Request) WafResult {
+	var res WafResult
+	values := map[string][]string{}
+	for _, rule := range this.Rules() {
+		for _, target := range rule.Targets {
+			vals, ok := values[target]
+			if !ok {
+				vals = this.values(r, target)
+				values[target] = vals
+			}
+			if value, ok := rule.match(vals); ok {
+				res.Matches = append(res.Matches, WafMatch{Rule: rule, Target: target, Value: wafTruncate(value)})
+				switch rule.Action {
+				case WafBlock:
+					res.Blocked = true
+				case WafScore:
+					res.Score += rule.Score
+				}
+				break
+			}
+		}
+	}
+	if this.Threshold > 0 && res.Score >= this.Threshold {
+		res.Blocked = true
+	}
+	return res
+}
+
+// 目標的值，已解碼
+func (this *Wafer) values(r *http.Request, target string) []string {
+	var vals []string
+	switch target {
+	case "path":
+		vals = []string{wafDecode(r.URL.EscapedPath(), false)}
+	case "query":
+		if r.URL.RawQuery != "" {
+			vals = []string{wafDecode(r.URL.RawQuery, true)}
+		}
+	case "headers":
+		for key, hv := range r.Header {
+			if key == "Cookie" {
+				continue
+			}
+			for _, v := range hv {
+				vals = append(vals, wafDecode(v, false))
+			}
+		}
+	case "cookies":
+		for _, c := range r.Cookies() {
+			vals = append(vals, wafDecode(c.Value, true))
+		}
+	case "body":
+		vals = this.body(r)
+	default:
+		if name, ok := strings.CutPrefix(target, "header:"); ok {
+			for _, v := range r.Header.Values(name) {
+				vals = append(vals, wafDecode(v, false))
+			}
+		}
+	}
+	return vals
+}
+
+// 讀取請求體的前MaxBody字節，讀取後放回；multipart表單只檢查非文件字段，文件内容不檢查
+func (this *Wafer) body(r *http.Request) []string {
+	if this.MaxBody <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, this.MaxBody))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) == 0 {
+		return nil
+	}
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return []string{wafDecode(string(body), true)}
+	}
+	// 超過MaxBody時最後一個字段只檢查截斷前的部分
+	var vals []string
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FileName() != "" {
+			continue
+		}
+		if v, _ := io.ReadAll(part); len(v) > 0 {
+			vals = append(vals, wafDecode(string(v), false))
+		}
+	}
+	return vals
+}
+
+func (this *Wafer) String() string {
+	return fmt.Sprintf("&{Files:%v Threshold:%d Detect:%v MaxBody:%d Rules:%d}",
+		this.Files, this.Threshold, this.Detect, this.MaxBody, len(this.Rules()))
+}
+
+// 匹配任一值，返回命中的值
+func (this *WafRule) match(vals []string) (string, bool) {
+	for _, v := range vals {
+		switch this.Op {
+		case "regex":
+			if this.re.MatchString(v) {
+				return v, true
+			}
+		case "contains":
+			if strings.Contains(strings.ToLower(v), this.Pattern) {
+				return v, true
+			}
+		case "length":
+			if len(v) > this.length {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// 解析規則，每行：id targets op action score pattern
+func parseWafRules(r io.Reader, name string) ([]*WafRule, error) {
+	var rules []*WafRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("%s:%d: expected id targets op action score pattern", name, n)
+		}
+		// pattern為第5個字段之後到行尾
+		pattern := line
+		for _, f := range fields[:5] {
+			pattern = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(pattern), f))
+		}
+		rule := &WafRule{ID: fields[0], Targets: strings.Split(fields[1], ","), Op: fields[2], Action: fields[3], Pattern: pattern}
+		var err error
+		if rule.Score, err = strconv.Atoi(fields[4]); err != nil {
+			return nil, fmt.Errorf("%s:%d: score: %w", name, n, err)
+		}
+		for _, target := range rule.Targets {
+			switch target {
+			case "path", "query", "headers", "cookies", "body":
+			default:
+				if !strings.HasPrefix(target, "header:") {
+					return nil, fmt.Errorf("%s:%d: unknown target %q", name, n, target)
+				}
+			}
+		}
+		switch rule.Action {
+		case WafBlock, WafLog, WafScore:
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", name, n, rule.Action)
+		}
+		switch rule.Op {
+		case "regex":
+			if rule.re, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+		case "contains":
+			rule.Pattern = strings.ToLower(pattern)
+		case "length":
+			if rule.length, err = strconv.Atoi(pattern); err != nil {
+				return nil, fmt.Errorf("%s:%d: length: %w", name, n, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown op %q", name, n, rule.Op)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// 解碼URL編碼(最多3層)、\uXXXX、%uXXXX和HTML實體，plus為true時+解碼為空格
+func wafDecode(s string, plus bool) string {
+	for i := 0; i < 3; i++ {
+		d := wafUnescape(s, plus)
+		if d == s {
+			break
+		}
+		s, plus = d, false
+	}
+	return html.UnescapeString(html.UnescapeString(s))
+}
+
+// 寬鬆的URL解碼，無效的轉義原樣保留，避免加入一個無效轉義使整串不解碼
+func wafUnescape(s string, plus bool) string {
+	if !strings.ContainsAny(s, `%\+`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+' && plus:
+			b.WriteByte(' ')
+			continue
+		case (c == '%' || c == '\\') && i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U'):
+			if v, err := strconv.ParseUint(s[i+2:i+6], 16, 32); err == nil {
+				b.WriteRune(rune(v))
+				i += 5
+				continue
+			}
+		case c == '%' && i+2 < len(s):
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// 截斷到64字節，不截斷多字節字符
+func wafTruncate(s string) string {
+	if len(s) <= 64 {
+		return s
+	}
+	n := 64
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,137 @@
+package goweber
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func wafRequest(method, target, body string, header http.Header) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if body != "" && r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r
+}
+
+const multipartType = "multipart/form-data; boundary=XYZ"
+
+// 文本字段中的XSS
+const multipartBody = "--XYZ\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nhello\r\n" +
+	"--XYZ\r\nContent-Disposition: form-data; name=\"text\"\r\n\r\n<script>alert(1)</script>\r\n--XYZ--\r\n"
+
+// 文件内容不檢查
+const multipartFile = "--XYZ\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.html\"\r\n\r\n<script>alert(1)</script>\r\n--XYZ--\r\n"
+
+func TestWafBaseline(t *testing.T) {
+	waf := NewWafer()
+	if err := waf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name    string
+		r       *http.Request
+		blocked bool
+	}{
+		{"union", wafRequest("GET", "/items?id=1%20UNION%20SELECT%20password%20FROM%20users", "", nil), true},
+		{"tautology", wafRequest("POST", "/login", "user=admin'+or+'1'%3D'1&pw=x", nil), true},
+		{"double encoded traversal", wafRequest("GET", "/files?name=%252e%252e%252fetc%252fpasswd", "", nil), true},
+		{"path traversal", wafRequest("GET", "/static/..%2f..%2fetc/passwd", "", nil), true},
+		{"unicode xss", wafRequest("GET", "/search?q=%u003cscript%u003ealert(1)", "", nil), true},
+		{"entity xss", wafRequest("POST", "/comment", "text=&lt;script&gt;alert(1)&lt;/script&gt;", nil), true},
+		{"json xss", wafRequest("POST", "/comment", `{"text":"<img src=x onerror=alert(1)>"}`, http.Header{"Content-Type": {"application/json"}}), true},
+		{"command", wafRequest("GET", "/ping?host=127.0.0.1;cat%20/etc/passwd", "", nil), true},
+		{"cookie", wafRequest("GET", "/", "", http.Header{"Cookie": {"sid=1%27%20union%20select%201--"}}), true},
+		{"scanner", wafRequest("GET", "/", "", http.Header{"User-Agent": {"sqlmap/1.7"}}), true},
+		{"invalid escape", wafRequest("GET", "/search?q=%zz%3Cscript%3E", "", nil), true},
+		{"search", wafRequest("GET", "/search?q=rock+and+roll+or+jazz&sort=date", "", nil), false},
+		{"select word", wafRequest("POST", "/comment", "text=Please select one and update your profile.", nil), false},
+		{"stacked query", wafRequest("GET", "/items?id=1;DROP%20TABLE%20users", "", nil), true},
+		{"semicolon prose", wafRequest("POST", "/comment", "text=ok; update it when you can; delete the draft", nil), false},
+		{"multipart field", wafRequest("POST", "/comment", multipartBody, http.Header{"Content-Type": {multipartType}}), true},
+		{"multipart file", wafRequest("POST", "/upload", multipartFile, http.Header{"Content-Type": {multipartType}}), false},
+		{"command word", wafRequest("GET", "/help?topic=cmd+line+tools", "", nil), false},
+		{"json", wafRequest("POST", "/api", `{"name":"O'Brien","note":"1 < 2"}`, http.Header{"Content-Type": {"application/json"}}), false},
+	} {
+		if res := waf.Inspect(c.r); res.Blocked != c.blocked {
+			t.Errorf("%s: blocked %v %+v", c.name, res.Blocked, res.Matches)
+		}
+	}
+}
+
+func TestWafRulesFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "waf.rules")
+	os.WriteFile(file, []byte(`# 自定義規則
+admin     path            contains  block  0  /wp-admin
+token     header:X-Token  length    score  3  8
+debug     query           regex     log    0  (?i)debug=1
+internal  query,body      contains  score  3  INTERNAL
+`), 0644)
+	waf := NewWafer()
+	waf.Files = []string{file}
+	if err := waf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(waf.Rules()) != 4 || waf.Rules()[2].Pattern != "(?i)debug=1" {
+		t.Fatalf("rules %+v", waf.Rules())
+	}
+	if !waf.Inspect(wafRequest("GET", "/WP-ADMIN/x", "", nil)).Blocked {
+		t.Fatal("contains not case insensitive")
+	}
+	res := waf.Inspect(wafRequest("GET", "/?debug=1", "", nil))
+	if res.Blocked || len(res.Matches) != 1 || res.Matches[0].Rule.ID != "debug" {
+		t.Fatalf("log rule %+v", res)
+	}
+	// 分數累加
+	res = waf.Inspect(wafRequest("POST", "/", "x=internal", http.Header{"X-Token": {"123456789"}}))
+	if !res.Blocked || res.Score != 6 {
+		t.Fatalf("score %+v", res)
+	}
+	os.WriteFile(file, []byte("bad path regex block 0 (\n"), 0644)
+	if err := waf.Load(); err == nil || !strings.Contains(err.Error(), "waf.rules:1") {
+		t.Fatalf("bad rule: %v", err)
+	}
+	os.WriteFile(file, []byte("bad form regex block 0 x\n"), 0644)
+	if err := waf.Load(); err == nil {
+		t.Fatal("unknown target accepted")
+	}
+}
+
+func TestWafServe(t *testing.T) {
+	app := newTestApp(t)
+	waf := NewWafer()
+	if err := waf.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var matched []WafResult
+	waf.OnMatch = func(r *http.Request, res WafResult) { matched = append(matched, res) }
+	app.Use(waf.Check)
+	app.Post("/echo", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	echo := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, wafRequest("POST", "/echo", body, nil))
+		return w
+	}
+	// 檢查後處理函數仍可讀取完整請求體
+	if w := echo("name=" + strings.Repeat("a", 100<<10)); w.Code != 200 || w.Body.Len() != 5+100<<10 {
+		t.Fatalf("body %d %d", w.Code, w.Body.Len())
+	}
+	if w := echo("q=<script>alert(1)</script>"); w.Code != http.StatusForbidden {
+		t.Fatalf("attack %d", w.Code)
+	}
+	// 只檢測模式
+	waf.Detect = true
+	if w := echo("q=<script>alert(1)</script>"); w.Code != 200 || len(matched) != 2 || !matched[1].Blocked {
+		t.Fatalf("detect %d %v", w.Code, matched)
+	}
+}
@@ -0,0 +1,150 @@
+// * 封禁事件通知
+// * 事件放入隊列，後台協程POST JSON到配置的URL，失敗時按指數退避重試
+// * 隊列已滿時丟棄事件，不阻塞請求處理
+// * 關閉時剩餘事件(包括重試)最多發送Drain時長，超時後中斷退避和請求，未發送的交給OnError
+package goweber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Webhooker 封禁事件通知，參數需在Start前設置
+// Webhooker posts ban events to a URL with retries
+type Webhooker struct {
+	URL     string                       // 通知地址
+	Header  map[string]string            // 附加請求頭，如Authorization
+	Retries int                          // 失敗重試次數
+	Backoff time.Duration                // 首次重試間隔，之後每次翻倍
+	Timeout time.Duration                // 單次請求超時
+	Drain   time.Duration                // 關閉時發送剩餘事件的最長時間
+	OnError func(ev BanEvent, err error) // 重試用盡或關閉時未能發送後調用
+	Client  *http.Client
+	queue   chan BanEvent
+	stop    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    sync.WaitGroup
+	once    sync.Once
+}
+
+func NewWebhooker(url string) *Webhooker {
+	return &Webhooker{
+		URL:     url,
+		Retries: 3,
+		Backoff: time.Second,
+		Timeout: 5 * time.Second,
+		Drain:   5 * time.Second,
+		queue:   make(chan BanEvent, 1024),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start 啓動後台發送協程
+// Start starts the sender goroutine
+func (this *Webhooker) Start() {
+	if this.Client == nil {
+		this.Client = &http.Client{Timeout: this.Timeout}
+	}
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+	this.done.Add(1)
+	go this.run()
+}
+
+// Notify 加入發送隊列，隊列已滿時返回false
+// Notify queues an event, false when the queue is full
+func (this *Webhooker) Notify(ev BanEvent) bool {
+	select {
+	case this.queue <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 在Drain內發送隊列中剩餘的事件(包括重試)後停止，超時後取消發送
+// Close sends the queued events, including retries, within Drain and cancels the rest
+func (this *Webhooker) Close() {
+	this.once.Do(func() {
+		close(this.stop)
+		if this.cancel != nil {
+			timer := time.AfterFunc(this.Drain, this.cancel)
+			defer timer.Stop()
+		}
+		this.done.Wait()
+	})
+}
+
+func (this *Webhooker) run() {
+	defer this.done.Done()
+	for {
+		select {
+		case ev := <-this.queue:
+			this.send(ev)
+		case <-this.stop:
+			for {
+				select {
+				case ev := <-this.queue:
+					this.send(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// 發送一個事件，失敗時重試，關閉超時後不再等待
+func (this *Webhooker) send(ev BanEvent) {
+	backoff := this.Backoff
+	var err error
+retry:
+	for i := 0; ; i++ {
+		if err = this.post(ev); err == nil {
+			return
+		}
+		if i >= this.Retries {
+			break
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-this.ctx.Done():
+			timer.Stop()
+			break retry
+		}
+		backoff *= 2
+	}
+	if this.OnError != nil {
+		this.OnError(ev, err)
+	}
+}
+
+func (this *Webhooker) post(ev BanEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(this.ctx, http.MethodPost, this.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range this.Header {
+		req.Header.Set(k, v)
+	}
+	res, err := this.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", this.URL, res.Status)
+	}
+	return nil
+}